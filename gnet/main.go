@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
 )
 
 type httpServer struct {
@@ -17,6 +22,10 @@ type httpServer struct {
 	addr      string
 	multicore bool
 	eng       gnet.Engine
+
+	// drain and conns let Shutdown close every connection
+	drain graceful.Drainer
+	conns sync.Map // gnet.Conn -> struct{}
 }
 
 func (hs *httpServer) OnBoot(eng gnet.Engine) gnet.Action {
@@ -25,11 +34,56 @@ func (hs *httpServer) OnBoot(eng gnet.Engine) gnet.Action {
 	return gnet.None
 }
 
+func (hs *httpServer) OnTick() (time.Duration, gnet.Action) {
+	return httpdate.Tick(), gnet.None
+}
+
 func (hs *httpServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	hs.drain.Open()
+	// stored before checking, so Shutdown sees it if the drain starts
+	// right after
+	hs.conns.Store(c, struct{}{})
+	if hs.drain.Draining() {
+		return nil, gnet.Close
+	}
 	return nil, gnet.None
 }
 
-var rsp = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello world!")
+func (hs *httpServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	hs.conns.Delete(c)
+	hs.drain.Close()
+	return gnet.None
+}
+
+// Shutdown refuses new connections and closes the open ones, after
+// answering what they already sent. The engine is stopped once they are
+// gone or ctx is done.
+func (hs *httpServer) Shutdown(ctx context.Context) error {
+	hs.drain.Begin()
+	hs.conns.Range(func(k, _ interface{}) bool {
+		// OnTraffic runs on the event loop of the connection and closes it,
+		// unless a request is only partly received
+		_ = k.(gnet.Conn).Wake(nil)
+		return true
+	})
+
+	err := hs.drain.Drain(ctx)
+	if stopErr := hs.eng.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+var (
+	rspHead = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\nDate: ")
+	rspTail = []byte("\r\n\r\nHello world!")
+	// sent while draining
+	rspCloseTail = []byte("\r\nConnection: close\r\n\r\nHello world!")
+)
+
+// maxHeaderSize bounds what is buffered while waiting for the end of a
+// request header.
+const maxHeaderSize = 8 << 10
 
 var bufferPool = sync.Pool{
 	New: func() interface{} {
@@ -43,26 +97,54 @@ func (hs *httpServer) OnTraffic(c gnet.Conn) gnet.Action {
 		buffer.Reset()
 		bufferPool.Put(buffer)
 	}()
-	_, _ = c.WriteTo(buffer)
-	if !bytes.Contains(buffer.Bytes(), []byte("\r\n\r\n")) {
-		logging.Errorf("no delimiter")
+	draining := hs.drain.Draining()
+	if draining && c.InboundBuffered() == 0 {
+		// woken by Shutdown while idle
 		return gnet.Close
 	}
-	_, _ = c.Write(rsp)
+	data, _ := c.Peek(-1)
+	if !bytes.Contains(data, []byte("\r\n\r\n")) {
+		if len(data) > maxHeaderSize {
+			logging.Errorf("no delimiter")
+			return gnet.Close
+		}
+		// wait for the rest of the request, during a drain too
+		return gnet.None
+	}
+	_, _ = c.Discard(len(data))
+	buffer.Write(rspHead)
+	buffer.Write(httpdate.Load())
+	if draining {
+		buffer.Write(rspCloseTail)
+		_, _ = c.Write(buffer.Bytes())
+		return gnet.Close
+	}
+	buffer.Write(rspTail)
+	_, _ = c.Write(buffer.Bytes())
 	return gnet.None
 }
 
 func main() {
 	var port int
 	var multicore bool
+	var shutdownTimeout time.Duration
 
 	// Example command: go run main.go --port 8080 --multicore=true
 	flag.IntVar(&port, "port", 8081, "server port")
 	flag.BoolVar(&multicore, "multicore", true, "multicore")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
 	flag.Parse()
 
 	hs := &httpServer{addr: fmt.Sprintf("tcp://:%d", port), multicore: multicore}
 
 	// Start serving!
-	log.Println("server exits:", gnet.Run(hs, hs.addr, gnet.WithMulticore(multicore)))
+	go func() {
+		if err := gnet.Run(hs, hs.addr, gnet.WithMulticore(multicore), gnet.WithTicker(true)); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	log.Println("server exits:", hs.Shutdown(ctx))
 }
@@ -7,10 +7,10 @@ toolchain go1.22.1
 require (
 	github.com/cloudwego/netpoll v0.6.0
 	github.com/cloudxaas/gostrconv v0.0.4
-	github.com/evanphx/wildcat v0.0.0-20141114174135-e7012f664567
 	github.com/lesismal/nbio v1.5.8
 	github.com/leslie-fei/gnettls v0.0.0-20240425065216-47a035c6596e
 	github.com/panjf2000/gnet/v2 v2.5.0
+	github.com/urpc/uio v0.0.0-20240527070139-ac985cf36ced
 	github.com/valyala/bytebufferpool v1.0.0
 	github.com/vektra/errors v0.0.0-20140903201135-c64d83aba85a
 	golang.org/x/sys v0.19.0
@@ -21,7 +21,6 @@ require (
 	github.com/cloudxaas/gocx v0.0.3 // indirect
 	github.com/libp2p/go-reuseport v0.4.0 // indirect
 	github.com/panjf2000/ants/v2 v2.9.0 // indirect
-	github.com/urpc/uio v0.0.0-20240527070139-ac985cf36ced // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.21.0 // indirect
@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"io"
+	"sync"
+)
+
+// Conns tracks the connections of a server whose engine cannot run code
+// on their event loop, so that the drain can close the idle ones right
+// away. The busy ones close themselves once they have answered. The zero
+// value is ready to use.
+type Conns struct {
+	m sync.Map // io.Closer -> *ConnState
+}
+
+// ConnState tells whether a connection is reading or answering a request.
+type ConnState struct {
+	mu     sync.Mutex
+	busy   bool
+	closed bool // by CloseIdle
+}
+
+// Add tracks c, from the open event of the engine, and returns the state
+// its handlers mark busy.
+func (cs *Conns) Add(c io.Closer) *ConnState {
+	s := &ConnState{}
+	cs.m.Store(c, s)
+	return s
+}
+
+// Remove forgets c, from the close event of the engine.
+func (cs *Conns) Remove(c io.Closer) {
+	cs.m.Delete(c)
+}
+
+// CloseIdle closes every connection that is not busy.
+func (cs *Conns) CloseIdle() {
+	cs.m.Range(func(k, v interface{}) bool {
+		s := v.(*ConnState)
+		s.mu.Lock()
+		if !s.busy && !s.closed {
+			s.closed = true
+			_ = k.(io.Closer).Close()
+		}
+		s.mu.Unlock()
+		return true
+	})
+}
+
+// Enter marks the connection busy. It must be called before any of the
+// data of a request is taken from the connection, so CloseIdle cannot
+// drop it, and returns false when CloseIdle already closed it.
+func (s *ConnState) Enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.busy = true
+	return true
+}
+
+// Leave marks the connection idle again.
+func (s *ConnState) Leave() {
+	s.mu.Lock()
+	s.busy = false
+	s.mu.Unlock()
+}
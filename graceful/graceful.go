@@ -0,0 +1,76 @@
+// Package graceful lets the servers of this repository finish their work
+// on SIGINT or SIGTERM instead of dropping in-flight requests.
+//
+// On the signal a server starts draining: it answers the requests it
+// already received with "Connection: close" and closes those connections,
+// then stops its engine once they are all gone or the deadline passes,
+// whichever comes first.
+package graceful
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout is how long a server may drain before it is stopped.
+const DefaultTimeout = 10 * time.Second
+
+const pollInterval = 50 * time.Millisecond
+
+// Wait blocks until SIGINT or SIGTERM and returns a context expiring
+// timeout later, the deadline for draining and stopping.
+func Wait(timeout time.Duration) (context.Context, context.CancelFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	signal.Stop(sig)
+
+	log.Printf("received %v, shutting down within %v", s, timeout)
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Drainer counts the open connections of a server and tells its handlers
+// when to close them. The zero value is ready to use.
+type Drainer struct {
+	draining atomic.Bool
+	conns    atomic.Int64
+}
+
+// Open and Close track a connection, from the open and close events of
+// the engine.
+func (d *Drainer) Open()  { d.conns.Add(1) }
+func (d *Drainer) Close() { d.conns.Add(-1) }
+
+// Draining reports whether responses must carry "Connection: close" and
+// end their connection.
+func (d *Drainer) Draining() bool {
+	return d.draining.Load()
+}
+
+// Begin starts draining without waiting, so the server can then wake its
+// idle connections to close them.
+func (d *Drainer) Begin() {
+	d.draining.Store(true)
+}
+
+// Drain starts draining and waits until every connection is closed or ctx
+// is done.
+func (d *Drainer) Drain(ctx context.Context) error {
+	d.Begin()
+
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for d.conns.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
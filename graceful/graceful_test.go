@@ -0,0 +1,75 @@
+package graceful
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	var d Drainer
+	d.Open()
+	d.Open()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.Close()
+		d.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Drain(ctx); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if !d.Draining() {
+		t.Errorf("Expected draining after Drain")
+	}
+
+	d.Open()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded with a connection left, got %v", err)
+	}
+}
+
+type closer struct{ closed int }
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestConnsCloseIdle(t *testing.T) {
+	var conns Conns
+	idle, busy := &closer{}, &closer{}
+	conns.Add(idle)
+	bs := conns.Add(busy)
+	if !bs.Enter() {
+		t.Fatal("Expected Enter on an open connection to succeed")
+	}
+
+	conns.CloseIdle()
+	if idle.closed != 1 || busy.closed != 0 {
+		t.Errorf("Expected only the idle connection closed, got %d and %d", idle.closed, busy.closed)
+	}
+
+	// closed once, even if the engine reports the close later
+	bs.Leave()
+	conns.CloseIdle()
+	if idle.closed != 1 || busy.closed != 1 {
+		t.Errorf("Expected every connection closed once, got %d and %d", idle.closed, busy.closed)
+	}
+	if bs.Enter() {
+		t.Error("Expected Enter on a connection CloseIdle closed to fail")
+	}
+
+	conns.Remove(idle)
+	conns.Remove(busy)
+	n := 0
+	conns.m.Range(func(k, v interface{}) bool { n++; return true })
+	if n != 0 {
+		t.Errorf("Expected no connection tracked, got %d", n)
+	}
+}
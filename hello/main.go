@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"sync"
 	"time"
 
 	"github.com/leslie-fei/gnettls"
@@ -14,6 +16,11 @@ import (
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
 	"github.com/panjf2000/gnet/v2/pkg/pool/goroutine"
+	"github.com/valyala/bytebufferpool"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
+	"gnet-example/timewheel"
 )
 
 func main() {
@@ -29,10 +36,15 @@ func main() {
 
 func runHTTPServer() {
 	var port int
-	var multicore bool
+	var multicore, async bool
+	var headerTimeout, idleTimeout, shutdownTimeout time.Duration
 
 	flag.IntVar(&port, "port", 443, "server port")
 	flag.BoolVar(&multicore, "multicore", true, "multicore with multiple CPU cores")
+	flag.BoolVar(&async, "async", false, "run handlers on a goroutine pool instead of the event loop")
+	flag.DurationVar(&headerTimeout, "header-timeout", 10*time.Second, "time allowed to receive a request header, 0 to disable")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 90*time.Second, "time a keep-alive connection may stay idle, 0 to disable")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
 	flag.Parse()
 
 	addr := fmt.Sprintf("tcp://:%d", port)
@@ -43,15 +55,32 @@ func runHTTPServer() {
 		addr:      addr,
 		multicore: multicore,
 		pool:      goroutine.Default(),
+		async:     async,
+
+		headerTimeout: headerTimeout,
+		idleTimeout:   idleTimeout,
+		// OnTick advances it once per second
+		wheel: timewheel.New(time.Second, 128),
 	}
 
 	options := []gnet.Option{
 		gnet.WithMulticore(multicore),
 		gnet.WithTCPKeepAlive(time.Minute * 5),
 		gnet.WithReusePort(true),
+		gnet.WithTicker(true),
 	}
 
-	log.Fatal(gnettls.Run(hs, hs.addr, tlsConfig, options...))
+	go func() {
+		if err := gnettls.Run(hs, hs.addr, tlsConfig, options...); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
 }
 
 type httpsServer struct {
@@ -61,6 +90,114 @@ type httpsServer struct {
 	multicore bool
 	eng       gnet.Engine
 	pool      *goroutine.Pool
+
+	// async runs respond on pool so a slow handler does not hold every
+	// connection of its event loop, see serveAsync
+	async bool
+
+	headerTimeout time.Duration
+	idleTimeout   time.Duration
+	wheel         *timewheel.Wheel
+
+	drain graceful.Drainer
+	conns sync.Map // gnet.Conn -> *connState
+}
+
+type connState struct {
+	timer   *timewheel.Timer
+	partial bool // part of a request has arrived
+
+	// async mode: requests are numbered as they arrive and responses
+	// written in that order, whatever order the pool finishes them in
+	seq      uint64 // number of the next request
+	next     uint64 // number of the next response to write
+	inflight int    // requests whose response is not written yet
+	done     map[uint64]*bytebufferpool.ByteBuffer
+	closed   bool
+}
+
+var (
+	rspHead = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\nDate: ")
+	rspTail = []byte("\r\n\r\nHello world!")
+	// sent while draining
+	rspCloseTail = []byte("\r\nConnection: close\r\n\r\nHello world!")
+)
+
+// OnTick refreshes the cached Date header and expires timeouts at every
+// second.
+func (hs *httpsServer) OnTick() (time.Duration, gnet.Action) {
+	hs.wheel.Advance()
+	return httpdate.Tick(), gnet.None
+}
+
+func (hs *httpsServer) OnBoot(eng gnet.Engine) gnet.Action {
+	hs.eng = eng
+	return gnet.None
+}
+
+// OnOpen fires once the TLS handshake is done.
+func (hs *httpsServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	if hs.drain.Draining() {
+		return nil, gnet.Close
+	}
+	cs := &connState{timer: timewheel.NewTimer(func() { _ = c.Close() })}
+	c.SetContext(cs)
+	hs.arm(cs, hs.headerTimeout)
+	hs.drain.Open()
+	hs.conns.Store(c, cs)
+	return nil, gnet.None
+}
+
+func (hs *httpsServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	// gnettls hands over the raw connection, whose context is the TLS
+	// connection OnOpen saw
+	if tc, ok := c.Context().(gnet.Conn); ok {
+		c = tc
+	}
+	if cs, ok := c.Context().(*connState); ok {
+		cs.closed = true
+		for seq, buf := range cs.done {
+			bytebufferpool.Put(buf)
+			delete(cs.done, seq)
+		}
+		hs.wheel.Stop(cs.timer)
+		hs.conns.Delete(c)
+		hs.drain.Close()
+	}
+	return gnet.None
+}
+
+// Shutdown refuses new connections, closes idle ones and lets the others
+// get the response to the request they are sending, with "Connection:
+// close". The engine is stopped once they are gone or ctx is done.
+func (hs *httpsServer) Shutdown(ctx context.Context) error {
+	hs.drain.Begin()
+	hs.conns.Range(func(k, v interface{}) bool {
+		c, cs := k.(gnet.Conn), v.(*connState)
+		// runs on the event loop of c
+		_ = c.Wake(func(gnet.Conn, error) error {
+			if !cs.partial && cs.inflight == 0 {
+				return c.Close()
+			}
+			return nil
+		})
+		return true
+	})
+
+	err := hs.drain.Drain(ctx)
+	if stopErr := hs.eng.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// arm restarts the timeout of the connection, or stops it when d is 0.
+func (hs *httpsServer) arm(cs *connState, d time.Duration) {
+	if d > 0 {
+		hs.wheel.Reset(cs.timer, d)
+	} else {
+		hs.wheel.Stop(cs.timer)
+	}
 }
 
 func (hs *httpsServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
@@ -68,14 +205,143 @@ func (hs *httpsServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 	// TODO decode http codec
 	// TODO handling http request and response content, should decode http request for yourself
 	// Must read the complete HTTP packet before responding.
-	if hs.isHTTPRequestComplete(c) {
-		_, _ = c.Next(-1)
-		// for example hello response
-		_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello world!"))
+	cs, ok := c.Context().(*connState)
+	if !ok {
+		return gnet.Close
+	}
+	if !hs.isHTTPRequestComplete(c) {
+		// the header timeout runs from the first byte, trickling more
+		// in does not extend it
+		if !cs.partial {
+			cs.partial = true
+			hs.arm(cs, hs.headerTimeout)
+		}
+		return
+	}
+	cs.partial = false
+	if hs.async {
+		hs.serveAsync(c, cs)
+		return
+	}
+	hs.arm(cs, hs.idleTimeout)
+
+	_, _ = c.Next(-1)
+	buf := bytebufferpool.Get()
+	draining := hs.drain.Draining()
+	hs.respond(buf, draining)
+	if draining {
+		action = gnet.Close
 	}
+	_, _ = c.Write(buf.B)
+	bytebufferpool.Put(buf)
 	return
 }
 
+// respond appends the response to a request to buf, with "Connection:
+// close" if last. In async mode it runs on the pool and may block.
+func (hs *httpsServer) respond(buf *bytebufferpool.ByteBuffer, last bool) {
+	// for example hello response
+	buf.Write(rspHead)
+	buf.Write(httpdate.Load())
+	if last {
+		buf.Write(rspCloseTail)
+	} else {
+		buf.Write(rspTail)
+	}
+}
+
+var crlfcrlf = []byte("\r\n\r\n")
+
+// serveAsync hands every complete request buffered on c to the pool. A
+// finished response comes back to the event loop through Wake, as the TLS
+// connection must only be written from there, and is queued with
+// AsyncWrite once all the responses before it were.
+func (hs *httpsServer) serveAsync(c gnet.Conn, cs *connState) {
+	data, _ := c.Peek(c.InboundBuffered())
+	draining := hs.drain.Draining()
+	n := 0
+	for {
+		i := bytes.Index(data[n:], crlfcrlf)
+		if i == -1 {
+			break
+		}
+		n += i + len(crlfcrlf)
+		// only the last request the client sent before we started
+		// draining is told the connection closes, nothing may follow
+		// that response
+		last := draining && n == len(data)
+
+		seq := cs.seq
+		cs.seq++
+		cs.inflight++
+		job := func() {
+			buf := bytebufferpool.Get()
+			hs.respond(buf, last)
+			err := c.Wake(func(gnet.Conn, error) error {
+				hs.flush(c, cs, seq, buf)
+				return nil
+			})
+			if err != nil {
+				// the engine is gone
+				bytebufferpool.Put(buf)
+			}
+		}
+		if err := hs.pool.Submit(job); err != nil {
+			// the pool is full, fall back to the event loop
+			job()
+		}
+	}
+	_, _ = c.Discard(n)
+
+	// no timeout while the pool works on the requests, flush arms the
+	// idle one after the last response
+	cs.partial = n < len(data)
+	if cs.partial {
+		hs.arm(cs, hs.headerTimeout)
+	} else {
+		hs.arm(cs, 0)
+	}
+}
+
+// flush runs on the event loop once the response to request seq is in
+// buf and writes every response that is next in line.
+func (hs *httpsServer) flush(c gnet.Conn, cs *connState, seq uint64, buf *bytebufferpool.ByteBuffer) {
+	if cs.closed {
+		bytebufferpool.Put(buf)
+		return
+	}
+	if cs.done == nil {
+		cs.done = make(map[uint64]*bytebufferpool.ByteBuffer)
+	}
+	cs.done[seq] = buf
+
+	for {
+		buf, ok := cs.done[cs.next]
+		if !ok {
+			break
+		}
+		delete(cs.done, cs.next)
+		cs.next++
+		cs.inflight--
+		err := c.AsyncWrite(buf.B, func(gnet.Conn, error) error {
+			bytebufferpool.Put(buf)
+			return nil
+		})
+		if err != nil {
+			bytebufferpool.Put(buf)
+		}
+	}
+
+	if cs.inflight > 0 || cs.partial {
+		return
+	}
+	if hs.drain.Draining() {
+		_ = c.Close()
+		return
+	}
+	hs.arm(cs, hs.idleTimeout)
+}
+
 func (hs *httpsServer) isHTTPRequestComplete(c gnet.Conn) bool {
 	buf, _ := c.Peek(c.InboundBuffered())
 	return bytes.Contains(buf, []byte("\r\n\r\n"))
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/panjf2000/gnet/v2/pkg/pool/goroutine"
+	"github.com/valyala/bytebufferpool"
+
+	"gnet-example/timewheel"
+)
+
+// fakeConn stands in for the TLS connection. Wake only records the
+// callback, so a test plays the event loop and runs them in any order.
+// Methods the server does not use fall through to the nil embedded
+// interface and panic.
+type fakeConn struct {
+	gnet.Conn
+	in     []byte
+	out    bytes.Buffer
+	ctx    interface{}
+	closed bool
+
+	mu    sync.Mutex // pool goroutines call Wake
+	wakes []gnet.AsyncCallback
+}
+
+func (fc *fakeConn) Peek(n int) ([]byte, error) {
+	return append([]byte(nil), fc.in[:n]...), nil
+}
+
+func (fc *fakeConn) Discard(n int) (int, error) {
+	fc.in = fc.in[n:]
+	return n, nil
+}
+
+func (fc *fakeConn) InboundBuffered() int       { return len(fc.in) }
+func (fc *fakeConn) Context() interface{}       { return fc.ctx }
+func (fc *fakeConn) SetContext(ctx interface{}) { fc.ctx = ctx }
+
+func (fc *fakeConn) AsyncWrite(b []byte, cb gnet.AsyncCallback) error {
+	fc.out.Write(b)
+	return cb(fc, nil)
+}
+
+func (fc *fakeConn) Close() error {
+	fc.closed = true
+	return nil
+}
+
+func (fc *fakeConn) Wake(cb gnet.AsyncCallback) error {
+	fc.mu.Lock()
+	fc.wakes = append(fc.wakes, cb)
+	fc.mu.Unlock()
+	return nil
+}
+
+// waitWakes waits for the pool to finish n jobs and returns their
+// callbacks.
+func (fc *fakeConn) waitWakes(t *testing.T, n int) []gnet.AsyncCallback {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fc.mu.Lock()
+		wakes := fc.wakes
+		fc.mu.Unlock()
+		if len(wakes) >= n {
+			return wakes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d wakes, got %d", n, len(wakes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestServer() *httpsServer {
+	return &httpsServer{
+		pool:          goroutine.Default(),
+		async:         true,
+		headerTimeout: 10 * time.Second,
+		idleTimeout:   90 * time.Second,
+		wheel:         timewheel.New(time.Second, 8),
+	}
+}
+
+func newFakeConn(hs *httpsServer) (*fakeConn, *connState) {
+	fc := &fakeConn{}
+	hs.OnOpen(fc)
+	return fc, fc.ctx.(*connState)
+}
+
+func response(s string) *bytebufferpool.ByteBuffer {
+	buf := bytebufferpool.Get()
+	buf.WriteString(s)
+	return buf
+}
+
+func TestFlushOrder(t *testing.T) {
+	hs := newTestServer()
+	fc, cs := newFakeConn(hs)
+	// three requests handed to the pool, as serveAsync does
+	cs.seq, cs.inflight = 3, 3
+
+	hs.flush(fc, cs, 2, response("C"))
+	if fc.out.Len() != 0 {
+		t.Fatalf("Expected nothing before the first response, got %q", fc.out.String())
+	}
+
+	hs.flush(fc, cs, 0, response("A"))
+	if got := fc.out.String(); got != "A" {
+		t.Fatalf("Expected %q, got %q", "A", got)
+	}
+
+	hs.flush(fc, cs, 1, response("B"))
+	if got := fc.out.String(); got != "ABC" {
+		t.Fatalf("Expected %q, got %q", "ABC", got)
+	}
+
+	if cs.inflight != 0 || len(cs.done) != 0 {
+		t.Errorf("Expected nothing in flight, got %d in flight and %d done", cs.inflight, len(cs.done))
+	}
+	if fc.closed {
+		t.Error("Expected the connection to stay open")
+	}
+}
+
+func TestFlushAfterClose(t *testing.T) {
+	hs := newTestServer()
+	fc, cs := newFakeConn(hs)
+	cs.seq, cs.inflight = 2, 2
+
+	hs.flush(fc, cs, 1, response("B"))
+	hs.OnClose(fc, nil)
+
+	if len(cs.done) != 0 {
+		t.Errorf("Expected OnClose to release the queued response, %d left", len(cs.done))
+	}
+
+	hs.flush(fc, cs, 0, response("A"))
+	if fc.out.Len() != 0 {
+		t.Errorf("Expected nothing written after OnClose, got %q", fc.out.String())
+	}
+}
+
+func TestServeAsyncDrain(t *testing.T) {
+	hs := newTestServer()
+	fc, _ := newFakeConn(hs)
+	hs.drain.Begin()
+
+	const n = 3
+	fc.in = []byte(strings.Repeat("GET / HTTP/1.1\r\nHost: a\r\n\r\n", n))
+	if action := hs.OnTraffic(fc); action != gnet.None {
+		t.Fatalf("Expected %v, got %v", gnet.None, action)
+	}
+	if len(fc.in) != 0 {
+		t.Fatalf("Expected the requests to be consumed, %d bytes left", len(fc.in))
+	}
+
+	// the pool finishes in any order, replay it backwards
+	wakes := fc.waitWakes(t, n)
+	for i := len(wakes) - 1; i >= 0; i-- {
+		if fc.closed {
+			t.Fatal("Expected no close before the last response")
+		}
+		_ = wakes[i](fc, nil)
+	}
+
+	out := fc.out.String()
+	if got := strings.Count(out, "HTTP/1.1 200 OK\r\n"); got != n {
+		t.Errorf("Expected %d responses, got %d in %q", n, got, out)
+	}
+	// RFC 9112 section 9.6, no response may follow the one announcing
+	// the close
+	if got := strings.Count(out, "Connection: close"); got != 1 || !strings.HasSuffix(out, "Connection: close\r\n\r\nHello world!") {
+		t.Errorf("Expected a single close on the final response, got %q", out)
+	}
+	if !fc.closed {
+		t.Error("Expected the connection to close after the last response")
+	}
+}
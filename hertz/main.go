@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"runtime"
 	"time"
 
 	"github.com/cloudwego/netpoll"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
 )
 
 func main() {
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
+	flag.Parse()
+
 	listener, err := netpoll.CreateListener("tcp", ":9998")
 	if err != nil {
 		panic("create netpoll listener failed")
@@ -25,10 +33,30 @@ func main() {
 		panic(err)
 	}
 
-	eventLoop.Serve(listener)
+	httpdate.Start()
+
+	go func() {
+		if err := eventLoop.Serve(listener); err != nil {
+			panic(err)
+		}
+	}()
+
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	// netpoll stops accepting, closes idle connections and waits for the
+	// busy ones itself
+	drain.Begin()
+	_ = eventLoop.Shutdown(ctx)
 }
 
-var rsp = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello world!")
+var (
+	rspHead = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\nDate: ")
+	rspTail = []byte("\r\n\r\nHello world!")
+	// sent while draining
+	rspCloseTail = []byte("\r\nConnection: close\r\n\r\nHello world!")
+)
+
+var drain graceful.Drainer
 
 func onReq(ctx context.Context, connection netpoll.Connection) error {
 	r := connection.Reader()
@@ -36,6 +64,18 @@ func onReq(ctx context.Context, connection netpoll.Connection) error {
 	if !bytes.Contains(buf, []byte("\r\n\r\n")) {
 		return errors.New("no delimiter")
 	}
-	_, _ = connection.Write(rsp)
-	return nil
+	// the date slice is never modified once published, so the writer may
+	// reference it instead of copying
+	w := connection.Writer()
+	_, _ = w.WriteBinary(rspHead)
+	_, _ = w.WriteBinary(httpdate.Load())
+	if drain.Draining() {
+		_, _ = w.WriteBinary(rspCloseTail)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return connection.Close()
+	}
+	_, _ = w.WriteBinary(rspTail)
+	return w.Flush()
 }
@@ -0,0 +1,131 @@
+package main
+
+import "bytes"
+
+// Args walks the name=value pairs of a query string or of an
+// application/x-www-form-urlencoded body without allocating. Names and
+// values are percent-decoded, '+' included; decoded results live in a
+// scratch buffer owned by Args and stay valid until the next call.
+type Args struct {
+	raw  []byte
+	rest []byte
+	buf  []byte
+}
+
+// Reset points the Args at a new encoded string and rewinds Next.
+func (a *Args) Reset(raw []byte) {
+	a.raw = raw
+	a.rest = raw
+	a.buf = a.buf[:0]
+}
+
+// Raw returns the encoded string the Args was reset with.
+func (a *Args) Raw() []byte {
+	return a.raw
+}
+
+// Next returns the next pair, or ok == false once all pairs were seen.
+// A pair without '=' has an empty, non-nil value.
+func (a *Args) Next() (name, value []byte, ok bool) {
+	a.buf = a.buf[:0]
+	name, value, a.rest, ok = a.next(a.rest)
+	return name, value, ok
+}
+
+// Peek returns the value of the first pair called name, or nil if there
+// is none. It does not disturb an iteration in progress with Next.
+func (a *Args) Peek(name []byte) []byte {
+	rest := a.raw
+	for {
+		mark := len(a.buf)
+
+		var n, v []byte
+		var ok bool
+
+		n, v, rest, ok = a.next(rest)
+		if !ok {
+			return nil
+		}
+
+		if bytes.Equal(n, name) {
+			return v
+		}
+
+		a.buf = a.buf[:mark]
+	}
+}
+
+// Has reports whether a pair called name is present.
+func (a *Args) Has(name []byte) bool {
+	return a.Peek(name) != nil
+}
+
+func (a *Args) next(rest []byte) (name, value, _ []byte, ok bool) {
+	for len(rest) > 0 {
+		var pair []byte
+		if i := bytes.IndexByte(rest, '&'); i != -1 {
+			pair, rest = rest[:i], rest[i+1:]
+		} else {
+			pair, rest = rest, nil
+		}
+
+		if len(pair) == 0 {
+			continue
+		}
+
+		name, value = pair, pair[len(pair):]
+		if i := bytes.IndexByte(pair, '='); i != -1 {
+			name, value = pair[:i], pair[i+1:]
+		}
+
+		name = a.decode(name)
+		value = a.decode(value)
+		return name, value, rest, true
+	}
+
+	return nil, nil, nil, false
+}
+
+func (a *Args) decode(src []byte) []byte {
+	if bytes.IndexByte(src, '%') == -1 && bytes.IndexByte(src, '+') == -1 {
+		return src
+	}
+
+	mark := len(a.buf)
+	a.buf = unescape(a.buf, src, true)
+	return a.buf[mark:]
+}
+
+// unescape appends src to dst with %XX sequences decoded, and '+' turned
+// into a space when plus is set. Malformed escapes are copied verbatim.
+func unescape(dst, src []byte, plus bool) []byte {
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '%' && i+2 < len(src) && isHex(src[i+1]) && isHex(src[i+2]):
+			dst = append(dst, unhex(src[i+1])<<4|unhex(src[i+2]))
+			i += 2
+		case c == '+' && plus:
+			dst = append(dst, ' ')
+		default:
+			dst = append(dst, c)
+		}
+	}
+
+	return dst
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
@@ -1,83 +1,441 @@
 package main
 
-import "io"
+import (
+	"bufio"
+	"bytes"
+	"io"
 
-type sizedBodyReader struct {
-	size int64
+	"github.com/vektra/errors"
+)
+
+// ErrBodyTooLarge is returned by a body reader, and by the server while
+// framing a request, once a body exceeds ParserLimits.MaxBodySize.
+var ErrBodyTooLarge = errors.New("body too large")
+
+// bodySource hands out the bytes read along with the header before
+// reading more from the connection.
+type bodySource struct {
 	rest []byte
 	c    io.ReadCloser
 }
 
+func (s *bodySource) Read(buf []byte) (int, error) {
+	if len(s.rest) > 0 {
+		n := copy(buf, s.rest)
+		s.rest = s.rest[n:]
+		return n, nil
+	}
+
+	return s.c.Read(buf)
+}
+
+// drain reads r to its end, reporting anything but a clean io.EOF.
+func drain(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+type sizedBodyReader struct {
+	src  bodySource
+	size int64 // bytes left
+	err  error
+}
+
 func (br *sizedBodyReader) Read(buf []byte) (int, error) {
+	if br.err != nil {
+		return 0, br.err
+	}
+
 	if br.size == 0 {
 		return 0, io.EOF
 	}
 
-	if br.rest != nil {
-		if len(buf) < len(br.rest) {
-			copy(buf, br.rest[:len(buf)])
+	if int64(len(buf)) > br.size {
+		buf = buf[:br.size]
+	}
 
-			br.rest = br.rest[len(buf):]
-			br.size -= int64(len(buf))
-			return len(buf), nil
-		} else {
-			l := len(br.rest)
-			copy(buf, br.rest)
+	n, err := br.src.Read(buf)
+	br.size -= int64(n)
 
-			br.rest = nil
-			br.size -= int64(l)
-			return l, nil
+	if err == io.EOF {
+		if br.size > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
 		}
 	}
 
-	n, err := br.c.Read(buf[:br.size])
 	if err != nil {
-		return 0, err
+		br.err = err
 	}
 
-	br.size -= int64(n)
-	return n, nil
+	return n, err
 }
 
+// Drain discards the rest of the body, leaving the connection positioned
+// at the next message.
+func (br *sizedBodyReader) Drain() error {
+	return drain(br)
+}
+
+// Close drains the body so the connection can be reused. The connection
+// is only closed when that fails.
 func (br *sizedBodyReader) Close() error {
-	return br.c.Close()
+	if err := br.Drain(); err != nil {
+		br.src.c.Close()
+		return err
+	}
+
+	return nil
 }
 
+// unsizedBodyReader reads a body delimited by the connection closing.
 type unsizedBodyReader struct {
-	rest []byte
-	c    io.ReadCloser
+	src  bodySource
+	max  int64
+	read int64
 }
 
 func (br *unsizedBodyReader) Read(buf []byte) (int, error) {
-	if br.rest != nil {
-		if len(buf) < len(br.rest) {
-			copy(buf, br.rest[:len(buf)])
+	if br.max > 0 {
+		if left := br.max - br.read + 1; int64(len(buf)) > left {
+			// one byte past the limit tells a full body from a long one
+			buf = buf[:left]
+		}
+	}
 
-			br.rest = br.rest[len(buf):]
-			return len(buf), nil
-		} else {
-			l := len(br.rest)
-			copy(buf, br.rest)
+	n, err := br.src.Read(buf)
+	br.read += int64(n)
 
-			br.rest = nil
-			return l, nil
-		}
+	if br.max > 0 && br.read > br.max {
+		n -= int(br.read - br.max)
+		br.read = br.max
+		return n, ErrBodyTooLarge
 	}
 
-	return br.c.Read(buf)
+	return n, err
+}
+
+// Drain discards the rest of the body, which means reading until the
+// peer closes the connection.
+func (br *unsizedBodyReader) Drain() error {
+	return drain(br)
 }
 
+// Close closes the connection, as the end of the body is its end too.
 func (br *unsizedBodyReader) Close() error {
-	return br.c.Close()
+	return br.src.c.Close()
+}
+
+// maxChunkLineSize bounds a single chunk-size or trailer line.
+const maxChunkLineSize = 4096
+
+type chunkedBodyReader struct {
+	r    *bufio.Reader
+	c    io.ReadCloser
+	n    int64 // bytes left in the current chunk
+	crlf bool  // chunk data was consumed, CRLF must follow
+	err  error
+
+	max  int64
+	read int64 // decoded bytes, including the current chunk
+
+	strict bool // see chunkScanner.strict
+}
+
+func (br *chunkedBodyReader) Read(buf []byte) (int, error) {
+	if br.err != nil {
+		return 0, br.err
+	}
+
+	if br.n == 0 {
+		if br.crlf {
+			if br.err = br.readCRLF(); br.err != nil {
+				return 0, br.err
+			}
+			br.crlf = false
+		}
+
+		if br.err = br.readChunkSize(); br.err != nil {
+			return 0, br.err
+		}
+
+		br.read += br.n
+		if br.max > 0 && br.read > br.max {
+			br.err = ErrBodyTooLarge
+			return 0, br.err
+		}
+
+		if br.n == 0 {
+			if br.err = br.readTrailers(); br.err == nil {
+				br.err = io.EOF
+			}
+			return 0, br.err
+		}
+	}
+
+	if int64(len(buf)) > br.n {
+		buf = buf[:br.n]
+	}
+
+	n, err := br.r.Read(buf)
+	br.n -= int64(n)
+	if br.n == 0 {
+		br.crlf = true
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		br.err = err
+	}
+
+	return n, err
 }
 
-func BodyReader(size int64, rest []byte, c io.ReadCloser) io.ReadCloser {
-	switch size {
-	case 0:
+func (br *chunkedBodyReader) readLine() ([]byte, error) {
+	line, err := br.r.ReadSlice('\n')
+	switch err {
+	case nil:
+	case bufio.ErrBufferFull:
+		return nil, errors.Context(ErrBadProto, "chunk line too long")
+	case io.EOF:
+		return nil, io.ErrUnexpectedEOF
+	default:
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	} else if br.strict {
+		return nil, errBareLF
+	}
+
+	return line, nil
+}
+
+func (br *chunkedBodyReader) readCRLF() error {
+	line, err := br.readLine()
+	if err != nil {
+		return err
+	}
+
+	if len(line) != 0 {
+		return errors.Context(ErrBadProto, "missing CRLF after chunk data")
+	}
+
+	return nil
+}
+
+func (br *chunkedBodyReader) readChunkSize() error {
+	line, err := br.readLine()
+	if err != nil {
+		return err
+	}
+
+	br.n, err = parseChunkSize(line, br.strict)
+	return err
+}
+
+// parseChunkSize parses a chunk-size line without its line ending. Strict
+// mode refuses whitespace after the size.
+func parseChunkSize(line []byte, strict bool) (int64, error) {
+	// Chunk extensions are allowed but carry nothing we use.
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	if !strict {
+		line = bytes.TrimRight(line, " \t")
+	}
+
+	if len(line) == 0 {
+		return 0, errors.Context(ErrBadProto, "empty chunk size")
+	}
+
+	var size int64
+	for _, c := range line {
+		if !isHex(c) {
+			return 0, errors.Context(ErrBadProto, "invalid chunk size")
+		}
+
+		if size > (1<<63-1)>>4 {
+			return 0, errors.Context(ErrBadProto, "chunk size overflow")
+		}
+		size = size<<4 | int64(unhex(c))
+	}
+
+	return size, nil
+}
+
+func (br *chunkedBodyReader) readTrailers() error {
+	for {
+		line, err := br.readLine()
+		if err != nil {
+			return err
+		}
+
+		if len(line) == 0 {
+			return nil
+		}
+	}
+}
+
+// Drain discards the rest of the body, trailers included.
+func (br *chunkedBodyReader) Drain() error {
+	return drain(br)
+}
+
+// Close drains the body so the connection can be reused. The connection
+// is only closed when that fails.
+func (br *chunkedBodyReader) Close() error {
+	if err := br.Drain(); err != nil {
+		br.c.Close()
+		return err
+	}
+
+	return nil
+}
+
+// ChunkedBodyReader decodes a Transfer-Encoding: chunked body, reading
+// rest first and then c. Trailers are consumed and discarded. A max above
+// zero caps the decoded size.
+//
+// Chunk lines are read through a buffer, so when c is a live connection
+// bytes after the body may be consumed; the server avoids this by handing
+// over bodies that are already complete in rest.
+func ChunkedBodyReader(max int64, rest []byte, c io.ReadCloser) io.ReadCloser {
+	return newChunkedBodyReader(max, false, rest, c)
+}
+
+func newChunkedBodyReader(max int64, strict bool, rest []byte, c io.ReadCloser) io.ReadCloser {
+	src := &bodySource{rest, c}
+	return &chunkedBodyReader{
+		r:      bufio.NewReaderSize(src, maxChunkLineSize),
+		c:      c,
+		max:    max,
+		strict: strict,
+	}
+}
+
+// chunkScanner finds where a chunked body ends in a buffer without
+// decoding it, so a server can wait until the whole body has arrived.
+// Like HTTPParser it resumes where it stopped on ErrMissingData.
+type chunkScanner struct {
+	offset   int // next line to look at, relative to the body start
+	trailers bool
+
+	max  int64 // cap on the decoded size, 0 for none
+	size int64 // decoded size of the chunks seen so far
+
+	// strict requires CRLF line endings and a bare chunk size, as
+	// HTTPParser.Strict does for the header: lenient chunk parsing that
+	// differs from a proxy's is a way to smuggle requests
+	strict bool
+}
+
+func (cs *chunkScanner) reset(max int64, strict bool) {
+	cs.offset = 0
+	cs.trailers = false
+	cs.max = max
+	cs.size = 0
+	cs.strict = strict
+}
+
+// scan returns the length of the chunked body at the start of body, or
+// ErrMissingData if it has not arrived completely yet.
+func (cs *chunkScanner) scan(body []byte) (int, error) {
+	for {
+		i := bytes.IndexByte(body[cs.offset:], '\n')
+		if i == -1 {
+			if len(body)-cs.offset > maxChunkLineSize {
+				return 0, errors.Context(ErrBadProto, "chunk line too long")
+			}
+			return 0, ErrMissingData
+		}
+
+		line := body[cs.offset : cs.offset+i]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		} else if cs.strict {
+			return 0, errBareLF
+		}
+		next := cs.offset + i + 1
+
+		if cs.trailers {
+			cs.offset = next
+			if len(line) == 0 {
+				return next, nil
+			}
+			continue
+		}
+
+		size, err := parseChunkSize(line, cs.strict)
+		if err != nil {
+			return 0, err
+		}
+
+		if size == 0 {
+			cs.offset = next
+			cs.trailers = true
+			continue
+		}
+
+		if cs.max > 0 && cs.size+size > cs.max {
+			return 0, ErrBodyTooLarge
+		}
+
+		if size > int64(len(body)-next) {
+			return 0, ErrMissingData
+		}
+
+		end := next + int(size)
+		switch {
+		case len(body)-end < 1, len(body)-end < 2 && body[end] == '\r':
+			return 0, ErrMissingData
+		case body[end] == '\n':
+			if cs.strict {
+				return 0, errBareLF
+			}
+			cs.offset = end + 1
+			cs.size += size
+		case body[end] == '\r' && body[end+1] == '\n':
+			cs.offset = end + 2
+			cs.size += size
+		default:
+			return 0, errors.Context(ErrBadProto, "missing CRLF after chunk data")
+		}
+	}
+}
+
+type eofBody struct{}
+
+func (eofBody) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (eofBody) Close() error { return nil }
+
+// NoBody is an empty source for body readers over a body that is already
+// completely in memory.
+var NoBody io.ReadCloser = eofBody{}
+
+// BodyReader returns a reader for a body of size bytes, or for a body
+// running until c is closed when size is -1. A max above zero caps the
+// size; a declared size over it, or below -1, fails on the first Read.
+// The readers also offer Drain() error to skip what the handler did not
+// read.
+func BodyReader(size, max int64, rest []byte, c io.ReadCloser) io.ReadCloser {
+	switch {
+	case size == 0:
 		return nil
-	case -1:
-		return &unsizedBodyReader{rest, c}
+	case size < -1:
+		return &sizedBodyReader{src: bodySource{rest, c}, err: errors.Context(ErrBadProto, "negative body size")}
+	case size == -1:
+		return &unsizedBodyReader{src: bodySource{rest, c}, max: max}
+	case max > 0 && size > max:
+		return &sizedBodyReader{src: bodySource{rest, c}, err: ErrBodyTooLarge}
 	default:
-		return &sizedBodyReader{size, rest, c}
+		return &sizedBodyReader{src: bodySource{rest, c}, size: size}
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/vektra/errors"
+
+	"gnet-example/httpdate"
+)
+
+// Cookies walks the name=value pairs of every Cookie header of a request
+// without allocating. Returned slices point into the request.
+type Cookies struct {
+	headers []header
+	rest    []byte
+}
+
+// Next returns the next cookie, or ok == false once all were seen.
+func (cs *Cookies) Next() (name, value []byte, ok bool) {
+	for {
+		for len(cs.rest) == 0 {
+			if len(cs.headers) == 0 {
+				return nil, nil, false
+			}
+
+			h := cs.headers[0]
+			cs.headers = cs.headers[1:]
+			if bytes.EqualFold(h.Name, knownHeaders[HeaderCookie]) {
+				cs.rest = h.Value
+			}
+		}
+
+		var pair []byte
+		if i := bytes.IndexByte(cs.rest, ';'); i != -1 {
+			pair, cs.rest = cs.rest[:i], cs.rest[i+1:]
+		} else {
+			pair, cs.rest = cs.rest, nil
+		}
+
+		pair = bytes.Trim(pair, " \t")
+		i := bytes.IndexByte(pair, '=')
+		if i <= 0 {
+			// not a cookie-pair, browsers skip these too
+			continue
+		}
+
+		name, value = pair[:i], pair[i+1:]
+		if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		return name, value, true
+	}
+}
+
+// Return an iterator over the request cookies.
+func (hp *HTTPParser) Cookies() Cookies {
+	return Cookies{headers: hp.Headers[:hp.NumHeaders]}
+}
+
+// Return the value of the first cookie called name, or nil.
+func (hp *HTTPParser) Cookie(name []byte) []byte {
+	cs := hp.Cookies()
+	for n, v, ok := cs.Next(); ok; n, v, ok = cs.Next() {
+		if bytes.Equal(n, name) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// SameSite is the SameSite attribute of a Set-Cookie header.
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota // attribute omitted
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// TimeFormat is the IMF-fixdate format of RFC 9110 section 5.6.7, used
+// for Date and Expires. Times must be in UTC.
+const TimeFormat = httpdate.TimeFormat
+
+var ErrBadCookie = errors.New("invalid cookie")
+
+// SetCookie describes a cookie to send in a Set-Cookie response header.
+type SetCookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	MaxAge  int // seconds, 0 omits the attribute, negative deletes the cookie
+	Expires time.Time
+
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// AppendTo appends the Set-Cookie header value to dst. It refuses names,
+// values and attributes that would break out of the header.
+func (sc *SetCookie) AppendTo(dst []byte) ([]byte, error) {
+	if len(sc.Name) == 0 || !validCookieString(sc.Name, isToken) {
+		return dst, errors.Context(ErrBadCookie, "name")
+	}
+
+	if !validCookieString(sc.Value, isCookieOctet) {
+		return dst, errors.Context(ErrBadCookie, "value")
+	}
+
+	if !validCookieString(sc.Path, isCookieAttr) || !validCookieString(sc.Domain, isCookieAttr) {
+		return dst, errors.Context(ErrBadCookie, "attribute")
+	}
+
+	dst = append(dst, sc.Name...)
+	dst = append(dst, '=')
+	dst = append(dst, sc.Value...)
+
+	if sc.Path != "" {
+		dst = append(dst, "; Path="...)
+		dst = append(dst, sc.Path...)
+	}
+
+	if sc.Domain != "" {
+		dst = append(dst, "; Domain="...)
+		dst = append(dst, sc.Domain...)
+	}
+
+	switch {
+	case sc.MaxAge > 0:
+		dst = append(dst, "; Max-Age="...)
+		dst = strconv.AppendInt(dst, int64(sc.MaxAge), 10)
+	case sc.MaxAge < 0:
+		dst = append(dst, "; Max-Age=0"...)
+	}
+
+	if !sc.Expires.IsZero() {
+		dst = append(dst, "; Expires="...)
+		dst = sc.Expires.UTC().AppendFormat(dst, TimeFormat)
+	}
+
+	if sc.Secure {
+		dst = append(dst, "; Secure"...)
+	}
+
+	if sc.HttpOnly {
+		dst = append(dst, "; HttpOnly"...)
+	}
+
+	switch sc.SameSite {
+	case SameSiteLax:
+		dst = append(dst, "; SameSite=Lax"...)
+	case SameSiteStrict:
+		dst = append(dst, "; SameSite=Strict"...)
+	case SameSiteNone:
+		dst = append(dst, "; SameSite=None"...)
+	}
+
+	return dst, nil
+}
+
+func validCookieString(s string, valid func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !valid(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isCookieOctet follows the cookie-octet rule of RFC 6265.
+func isCookieOctet(c byte) bool {
+	return isVisible(c) && c < 0x80 && c != '"' && c != ',' && c != ';' && c != '\\'
+}
+
+func isCookieAttr(c byte) bool {
+	return isVisible(c) && c < 0x80 && c != ';'
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/vektra/errors"
+)
+
+var ErrNotForm = errors.New("not an application/x-www-form-urlencoded request")
+
+var cFormURLEncoded = []byte("application/x-www-form-urlencoded")
+
+type pathParam struct {
+	name, value []byte
+}
+
+// AddPathParam records a parameter captured from the path, normally by
+// the router. It is dropped with the rest of the request on Reset.
+func (hp *HTTPParser) AddPathParam(name, value []byte) {
+	hp.pathParams = append(hp.pathParams, pathParam{name, value})
+}
+
+// unescapePathParams percent-decodes the parameters the router captured
+// from the raw path, into a buffer owned by the parser.
+func (hp *HTTPParser) unescapePathParams() {
+	// a decoded value is never longer, so buf does not move while the
+	// values are sliced out of it
+	n := 0
+	for _, p := range hp.pathParams {
+		if bytes.IndexByte(p.value, '%') != -1 {
+			n += len(p.value)
+		}
+	}
+	if n == 0 {
+		return
+	}
+	if cap(hp.paramBuf) < n {
+		hp.paramBuf = make([]byte, 0, n)
+	}
+
+	buf := hp.paramBuf[:0]
+	for i, p := range hp.pathParams {
+		if bytes.IndexByte(p.value, '%') == -1 {
+			continue
+		}
+		start := len(buf)
+		buf = unescape(buf, p.value, false)
+		hp.pathParams[i].value = buf[start:len(buf):len(buf)]
+	}
+}
+
+// Return the value of the path parameter called name, or nil.
+func (hp *HTTPParser) PathParam(name []byte) []byte {
+	for _, p := range hp.pathParams {
+		if bytes.Equal(p.name, name) {
+			return p.value
+		}
+	}
+
+	return nil
+}
+
+// ReadForm reads an application/x-www-form-urlencoded body, normally the
+// reader BodyReader returned, into a buffer owned by the parser. The body
+// may not exceed Limits.MaxFormSize. A nil body is an empty form.
+func (hp *HTTPParser) ReadForm(body io.Reader) error {
+	mediaType := hp.HeaderValue(HeaderContentType)
+	if i := bytes.IndexByte(mediaType, ';'); i != -1 {
+		mediaType = mediaType[:i]
+	}
+
+	if !bytes.EqualFold(bytes.Trim(mediaType, " \t"), cFormURLEncoded) {
+		return ErrNotForm
+	}
+
+	buf := hp.formBuf[:0]
+	for body != nil {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+
+		n, err := body.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if max := hp.Limits.MaxFormSize; max > 0 && int64(len(buf)) > max {
+			return ErrBodyTooLarge
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	hp.formBuf = buf
+	hp.form.Reset(buf)
+	return nil
+}
+
+// Return the decoded form fields read by ReadForm. The Args belongs to
+// the parser and is reset with the next request.
+func (hp *HTTPParser) FormArgs() *Args {
+	return &hp.form
+}
+
+// Return the decoded value of the first form field called name, or nil.
+func (hp *HTTPParser) FormValue(name []byte) []byte {
+	return hp.form.Peek(name)
+}
+
+// Param looks name up as a path parameter, then a query parameter, then
+// a form field read by ReadForm, and returns the first value found.
+func (hp *HTTPParser) Param(name []byte) []byte {
+	if v := hp.PathParam(name); v != nil {
+		return v
+	}
+
+	if v := hp.QueryArg(name); v != nil {
+		return v
+	}
+
+	return hp.FormValue(name)
+}
@@ -0,0 +1,54 @@
+package main
+
+// Handler serves a request parsed into hc and builds its response there,
+// with appendResponse or setStatus, addHeader and Write. A *Router is a
+// Handler, as is a HandlerFunc.
+type Handler interface {
+	Serve(hc *httpCodec)
+}
+
+// HandlerFunc serves a routed request and appends its response to hc.
+type HandlerFunc func(hc *httpCodec)
+
+// Serve calls f(hc).
+func (f HandlerFunc) Serve(hc *httpCodec) {
+	f(hc)
+}
+
+// Middleware wraps a handler to run code around it, or instead of it. It
+// must call next.Serve to pass the request on.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in mw. The first middleware is the outermost one and sees
+// the request first.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Before returns a middleware running f ahead of the handler. f returning
+// false short-circuits the chain, in which case it should have appended
+// the response itself, e.g. with appendStatus; an empty 200 is sent
+// otherwise.
+func Before(f func(hc *httpCodec) bool) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(hc *httpCodec) {
+			if f(hc) {
+				next.Serve(hc)
+			}
+		})
+	}
+}
+
+// After returns a middleware running f once the handler returned, when
+// statusCode tells the status of the response.
+func After(f func(hc *httpCodec)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(hc *httpCodec) {
+			next.Serve(hc)
+			f(hc)
+		})
+	}
+}
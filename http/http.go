@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"io"
-	"strconv"
 
 	"github.com/vektra/errors"
 )
@@ -18,14 +17,66 @@ type header struct {
 type HTTPParser struct {
 	Method, Path, Version []byte
 
+	headerParser
+
+	rawPath, rawQuery []byte
+	urlPath, pathBuf  []byte
+	query             Args
+	targetRead        bool
+
+	pathParams []pathParam
+	paramBuf   []byte
+	form       Args
+	formBuf    []byte
+}
+
+// headerParser is the state machine shared by HTTPParser and
+// HTTPResponseParser: a start line followed by the header block, plus
+// everything derived from the headers alone.
+type headerParser struct {
 	Headers      []header
 	TotalHeaders int
+	NumHeaders   int // headers of the current message, Headers[:NumHeaders]
 
-	host     []byte
-	hostRead bool
+	ProtoMajor, ProtoMinor int // from Version, only 1.x is accepted
+
+	known [numKnownHeaders]int32 // index+1 into Headers, 0 when absent
 
 	contentLength     int64
 	contentLengthRead bool
+
+	chunked bool
+
+	Limits ParserLimits
+
+	// Strict enables RFC 9112 validation: token characters in the method
+	// and header names, CRLF line endings only, no obs-fold and exactly one
+	// way of framing the body. Use it whenever requests may have passed
+	// through another HTTP hop, lax parsing is what request smuggling abuses.
+	Strict bool
+
+	ps parseState
+}
+
+// ParserLimits bounds how much of a message Parse and the body readers
+// will accept before giving up. A zero field disables that limit.
+type ParserLimits struct {
+	MaxRequestLineSize int // request or status line including CRLF
+	MaxHeaderCount     int
+	MaxHeaderSize      int // a single header line, continuation lines included
+	MaxHeaderBytes     int // the start line and all headers
+
+	MaxBodySize int64 // decoded body, enforced by BodyReader
+	MaxFormSize int64 // urlencoded body, enforced by ReadForm
+}
+
+var DefaultParserLimits = ParserLimits{
+	MaxRequestLineSize: 8 << 10,
+	MaxHeaderCount:     100,
+	MaxHeaderSize:      8 << 10,
+	MaxHeaderBytes:     64 << 10,
+	MaxBodySize:        4 << 20,
+	MaxFormSize:        1 << 20,
 }
 
 const DefaultHeaderSlice = 10
@@ -38,9 +89,17 @@ func NewHTTPParser() *HTTPParser {
 // Create a new parser allocating size for size headers
 func NewSizedHTTPParser(size int) *HTTPParser {
 	return &HTTPParser{
+		headerParser: newHeaderParser(size, eMethod),
+	}
+}
+
+func newHeaderParser(size, first int) headerParser {
+	return headerParser{
 		Headers:       make([]header, size),
 		TotalHeaders:  size,
 		contentLength: -1,
+		Limits:        DefaultParserLimits,
+		ps:            parseState{first: first, state: first},
 	}
 }
 
@@ -48,10 +107,26 @@ var (
 	ErrBadProto    = errors.New("bad protocol")
 	ErrMissingData = errors.New("missing data")
 	ErrUnsupported = errors.New("unsupported http feature")
+
+	// ErrUnsupportedVersion is a well formed version other than HTTP/1.x.
+	ErrUnsupportedVersion = errors.New("unsupported http version")
+
+	// Limit errors, see ParserLimits. The first maps to 414, the rest to 431.
+	ErrRequestLineTooLong  = errors.New("request line too long")
+	ErrTooManyHeaders      = errors.New("too many headers")
+	ErrHeaderTooLarge      = errors.New("header too large")
+	ErrHeaderBytesTooLarge = errors.New("header block too large")
 )
 
 const (
-	eNextHeader int = iota
+	eMethod int = iota
+	ePath
+	eVersion
+	eStatusVersion
+	eStatusCode
+	eReason
+	eStartLineN
+	eNextHeader
 	eNextHeaderN
 	eHeader
 	eHeaderValueSpace
@@ -61,163 +136,350 @@ const (
 	eMLHeaderValue
 )
 
+// span locates a token by offset in the input given to Parse. Offsets stay
+// valid when the caller's buffer moves between calls, slices would not.
+type span struct {
+	start, end int
+}
+
+type headerSpan struct {
+	name, value span
+	folded      []byte // value joined with its obs-fold continuation lines
+}
+
+// parseState is where Parse stopped the last time it ran out of input.
+type parseState struct {
+	first  int // state a new message starts in
+	state  int
+	offset int
+	start  int
+
+	// start line: method, target and version of a request, or version,
+	// status code and reason of a response
+	tokens [3]span
+
+	line  int // start of the header line being scanned
+	name  span
+	spans []headerSpan
+}
+
+func (ps *parseState) reset() {
+	ps.state = ps.first
+	ps.offset = 0
+	ps.start = 0
+	ps.spans = ps.spans[:0]
+}
+
 // Parse the buffer as an HTTP Request. The buffer must contain the entire
-// request or Parse will return ErrMissingData for the caller to get more
-// data. (this thusly favors getting a completed request in a single Read()
-// call).
+// request header or Parse will return ErrMissingData for the caller to get
+// more data.
+//
+// Parsing is resumable: after ErrMissingData the parser remembers where it
+// stopped, and the next call only scans the bytes beyond that point. The
+// caller must pass the same request again with the new data appended; the
+// buffer itself may have moved. An input shorter than what was already
+// scanned starts a new request.
 //
 // Returns the number of bytes used by the header (thus where the body begins).
 // Also can return ErrUnsupported if an HTTP feature is detected but not supported.
 func (hp *HTTPParser) Parse(input []byte) (int, error) {
-	var headers int
-	var path int
-	var ok bool
+	if hp.ps.offset > len(input) {
+		hp.ps.reset()
+	}
 
-	total := len(input)
+	if hp.ps.offset == 0 {
+		hp.Reset()
+	}
 
-method:
-	for i := 0; i < total; i++ {
-		switch input[i] {
-		case ' ', '\t':
-			hp.Method = input[0:i]
-			ok = true
-			path = i + 1
-			break method
-		}
+	n, err := hp.parse(input)
+	if err == nil {
+		hp.Method = hp.ps.tokens[0].of(input)
+		hp.Path = hp.ps.tokens[1].of(input)
+		hp.Version = hp.ps.tokens[2].of(input)
+
+		n, err = hp.finish(n)
 	}
 
-	if !ok {
-		return 0, ErrMissingData
+	if err != ErrMissingData {
+		hp.ps.reset()
 	}
 
-	var version int
+	return n, err
+}
 
-	ok = false
+// Reset forgets everything about the previous request, including a
+// partially parsed one, so the parser can be reused on a keep-alive
+// connection. Parse calls it itself whenever it starts on a new request.
+func (hp *HTTPParser) Reset() {
+	hp.Method, hp.Path, hp.Version = nil, nil, nil
 
-path:
-	for i := path; i < total; i++ {
-		switch input[i] {
-		case ' ', '\t':
-			ok = true
-			hp.Path = input[path:i]
-			version = i + 1
-			break path
-		}
-	}
+	hp.rawPath, hp.rawQuery, hp.urlPath = nil, nil, nil
+	hp.query.Reset(nil)
+	hp.targetRead = false
 
-	if !ok {
-		return 0, ErrMissingData
-	}
+	hp.pathParams = hp.pathParams[:0]
+	hp.form.Reset(nil)
+
+	hp.headerParser.reset()
+}
+
+func (hp *headerParser) reset() {
+	hp.NumHeaders = 0
+	hp.ProtoMajor, hp.ProtoMinor = 0, 0
+	hp.known = [numKnownHeaders]int32{}
 
-	var readN bool
+	hp.contentLength = -1
+	hp.contentLengthRead = false
 
-	ok = false
-loop:
-	for i := version; i < total; i++ {
+	hp.chunked = false
+
+	hp.ps.reset()
+}
+
+func (hp *headerParser) parse(input []byte) (int, error) {
+	ps := &hp.ps
+
+	total := len(input)
+	state := ps.state
+	start := ps.start
+	strict := hp.Strict
+
+	i := ps.offset
+	for ; i < total; i++ {
 		c := input[i]
 
-		switch readN {
-		case false:
+		switch state {
+		case eMethod:
+			switch c {
+			case ' ', '\t':
+				if strict && (c != ' ' || i == 0) {
+					return 0, errors.Context(ErrBadProto, "invalid method")
+				}
+				ps.tokens[0] = span{0, i}
+				start = i + 1
+				state = ePath
+			default:
+				if strict && !isToken(c) {
+					return 0, errors.Context(ErrBadProto, "invalid method")
+				}
+			}
+		case ePath:
+			switch c {
+			case ' ', '\t':
+				if strict && (c != ' ' || i == start) {
+					return 0, errors.Context(ErrBadProto, "invalid request target")
+				}
+				ps.tokens[1] = span{start, i}
+				start = i + 1
+				state = eVersion
+			default:
+				if strict && !isVisible(c) {
+					return 0, errors.Context(ErrBadProto, "invalid request target")
+				}
+			}
+		case eVersion:
 			switch c {
 			case '\r':
-				hp.Version = input[version:i]
-				readN = true
+				ps.tokens[2] = span{start, i}
+				state = eStartLineN
 			case '\n':
-				hp.Version = input[version:i]
-				headers = i + 1
-				ok = true
-				break loop
-			}
-		case true:
-			if c != '\n' {
-				return 0, errors.Context(ErrBadProto, "missing newline in version")
+				if strict {
+					return 0, errBareLF
+				}
+				ps.tokens[2] = span{start, i}
+				state = eNextHeader
+			default:
+				continue
 			}
-			headers = i + 1
-			ok = true
-			break loop
-		}
-	}
-
-	if !ok {
-		return 0, ErrMissingData
-	}
-
-	var h int
 
-	var headerName []byte
+			n := i + 1
+			if c == '\r' {
+				n++ // the LF still to come counts too
+			}
+			if max := hp.Limits.MaxRequestLineSize; max > 0 && n > max {
+				return 0, ErrRequestLineTooLong
+			}
+		case eStatusVersion:
+			switch c {
+			case ' ':
+				if i == 0 {
+					return 0, errors.Context(ErrBadProto, "invalid status line")
+				}
+				ps.tokens[0] = span{0, i}
+				start = i + 1
+				state = eStatusCode
+			default:
+				if !isVisible(c) {
+					return 0, errors.Context(ErrBadProto, "invalid status line")
+				}
+			}
+		case eStatusCode:
+			switch {
+			case isDigit(c):
+				if i-start == 3 {
+					return 0, errors.Context(ErrBadProto, "invalid status code")
+				}
+				continue
+			case i-start != 3:
+				return 0, errors.Context(ErrBadProto, "invalid status code")
+			}
 
-	state := eNextHeader
+			ps.tokens[1] = span{start, i}
+			switch c {
+			case ' ':
+				start = i + 1
+				state = eReason
+				continue
+			case '\r':
+				state = eStartLineN
+			case '\n':
+				if strict {
+					return 0, errBareLF
+				}
+				state = eNextHeader
+			default:
+				return 0, errors.Context(ErrBadProto, "invalid status code")
+			}
 
-	start := headers
+			// no reason phrase at all
+			ps.tokens[2] = span{i, i}
+		case eReason:
+			switch c {
+			case '\r':
+				ps.tokens[2] = span{start, i}
+				state = eStartLineN
+			case '\n':
+				if strict {
+					return 0, errBareLF
+				}
+				ps.tokens[2] = span{start, i}
+				state = eNextHeader
+			default:
+				if strict && !isFieldValue(c) {
+					return 0, errors.Context(ErrBadProto, "invalid reason phrase")
+				}
+				continue
+			}
 
-	for i := headers; i < total; i++ {
-		switch state {
+			n := i + 1
+			if c == '\r' {
+				n++ // the LF still to come counts too
+			}
+			if max := hp.Limits.MaxRequestLineSize; max > 0 && n > max {
+				return 0, ErrRequestLineTooLong
+			}
+		case eStartLineN:
+			if c != '\n' {
+				return 0, errors.Context(ErrBadProto, "missing newline after start line")
+			}
+			state = eNextHeader
 		case eNextHeader:
-			switch input[i] {
+			switch c {
 			case '\r':
 				state = eNextHeaderN
 			case '\n':
-				return i + 1, nil
+				if strict {
+					return 0, errBareLF
+				}
+				return hp.complete(input, i+1)
 			case ' ', '\t':
+				if strict {
+					return 0, errors.Context(ErrBadProto, "obsolete line folding")
+				}
+				if len(ps.spans) == 0 {
+					return 0, errors.Context(ErrBadProto, "continuation line without header")
+				}
 				state = eMLHeaderStart
 			default:
+				if strict && !isToken(c) {
+					return 0, errors.Context(ErrBadProto, "invalid header name")
+				}
 				start = i
+				ps.line = i
 				state = eHeader
 			}
 		case eNextHeaderN:
-			if input[i] != '\n' {
+			if c != '\n' {
 				return 0, ErrBadProto
 			}
 
-			return i + 1, nil
+			return hp.complete(input, i+1)
 		case eHeader:
-			if input[i] == ':' {
-				headerName = input[start:i]
+			switch c {
+			case ':':
+				ps.name = span{start, i}
 				state = eHeaderValueSpace
+			case '\n':
+				return 0, errors.Context(ErrBadProto, "missing colon in header")
+			default:
+				if strict && !isToken(c) {
+					return 0, errors.Context(ErrBadProto, "invalid header name")
+				}
 			}
 		case eHeaderValueSpace:
-			switch input[i] {
+			switch c {
 			case ' ', '\t':
 				continue
+			case '\r':
+				state = eHeaderValueN
+			case '\n':
+				if strict {
+					return 0, errBareLF
+				}
+				state = eNextHeader
+			default:
+				if strict && !isFieldValue(c) {
+					return 0, errors.Context(ErrBadProto, "invalid header value")
+				}
+				start = i
+				state = eHeaderValue
+				continue
 			}
 
-			start = i
-			state = eHeaderValue
+			if err := hp.addHeader(span{i, i}); err != nil {
+				return 0, err
+			}
 		case eHeaderValue:
-			switch input[i] {
+			switch c {
 			case '\r':
 				state = eHeaderValueN
 			case '\n':
+				if strict {
+					return 0, errBareLF
+				}
 				state = eNextHeader
 			default:
+				if strict && !isFieldValue(c) {
+					return 0, errors.Context(ErrBadProto, "invalid header value")
+				}
 				continue
 			}
 
-			hp.Headers[h] = header{headerName, input[start:i]}
-			h++
-
-			if h == hp.TotalHeaders {
-				newHeaders := make([]header, hp.TotalHeaders+10)
-				copy(newHeaders, hp.Headers)
-				hp.Headers = newHeaders
-				hp.TotalHeaders += 10
+			if err := hp.addHeader(trimOWS(input, start, i)); err != nil {
+				return 0, err
 			}
 		case eHeaderValueN:
-			if input[i] != '\n' {
+			if c != '\n' {
 				return 0, ErrBadProto
 			}
 			state = eNextHeader
 
 		case eMLHeaderStart:
-			switch input[i] {
+			switch c {
 			case ' ', '\t':
 				continue
+			case '\r':
+				state = eHeaderValueN
+				continue
+			case '\n':
+				state = eNextHeader
+				continue
 			}
 
 			start = i
 			state = eMLHeaderValue
 		case eMLHeaderValue:
-			switch input[i] {
+			switch c {
 			case '\r':
 				state = eHeaderValueN
 			case '\n':
@@ -226,29 +488,248 @@ loop:
 				continue
 			}
 
-			cur := hp.Headers[h-1].Value
+			last := &ps.spans[len(ps.spans)-1]
+
+			cur := last.folded
+			if cur == nil {
+				cur = input[last.value.start:last.value.end]
+			}
+			v := trimOWS(input, start, i)
 
-			newheader := make([]byte, len(cur)+1+(i-start))
+			newheader := make([]byte, len(cur)+1+(v.end-v.start))
 			copy(newheader, cur)
-			copy(newheader[len(cur):], []byte(" "))
-			copy(newheader[len(cur)+1:], input[start:i])
+			newheader[len(cur)] = ' '
+			copy(newheader[len(cur)+1:], input[v.start:v.end])
+
+			last.folded = newheader
 
-			hp.Headers[h-1].Value = newheader
+			if max := hp.Limits.MaxHeaderSize; max > 0 && i-ps.line > max {
+				return 0, ErrHeaderTooLarge
+			}
 		}
 	}
 
+	if err := hp.checkPartial(state, i); err != nil {
+		return 0, err
+	}
+
+	ps.state = state
+	ps.start = start
+	ps.offset = i
+
 	return 0, ErrMissingData
 }
 
-// Return a value of a header matching name.
-func (hp *HTTPParser) FindHeader(name []byte) []byte {
-	for _, header := range hp.Headers {
+func (hp *headerParser) addHeader(value span) error {
+	ps := &hp.ps
+
+	if max := hp.Limits.MaxHeaderCount; max > 0 && len(ps.spans) >= max {
+		return ErrTooManyHeaders
+	}
+
+	if max := hp.Limits.MaxHeaderSize; max > 0 && value.end-ps.line > max {
+		return ErrHeaderTooLarge
+	}
+
+	ps.spans = append(ps.spans, headerSpan{name: ps.name, value: value})
+	return nil
+}
+
+// checkPartial applies the limits to an incomplete header, so a client
+// cannot make the caller buffer more than the limits allow.
+func (hp *headerParser) checkPartial(state, scanned int) error {
+	l := &hp.Limits
+
+	if l.MaxHeaderBytes > 0 && scanned > l.MaxHeaderBytes {
+		return ErrHeaderBytesTooLarge
+	}
+
+	if state < eNextHeader {
+		if l.MaxRequestLineSize > 0 && scanned > l.MaxRequestLineSize {
+			return ErrRequestLineTooLong
+		}
+		return nil
+	}
+
+	switch state {
+	case eHeader, eHeaderValueSpace, eHeaderValue, eMLHeaderStart, eMLHeaderValue:
+		if l.MaxHeaderSize > 0 && scanned-hp.ps.line > l.MaxHeaderSize {
+			return ErrHeaderTooLarge
+		}
+	}
+
+	return nil
+}
+
+// trimOWS drops the optional whitespace trailing a header value.
+func trimOWS(input []byte, start, end int) span {
+	for end > start && (input[end-1] == ' ' || input[end-1] == '\t') {
+		end--
+	}
+
+	return span{start, end}
+}
+
+func (sp span) of(input []byte) []byte {
+	return input[sp.start:sp.end]
+}
+
+// complete turns the recorded header offsets into slices of input once the
+// whole header block has been seen. The start line is left to the caller.
+func (hp *headerParser) complete(input []byte, n int) (int, error) {
+	ps := &hp.ps
+
+	if max := hp.Limits.MaxHeaderBytes; max > 0 && n > max {
+		return 0, ErrHeaderBytesTooLarge
+	}
+
+	if len(ps.spans) >= hp.TotalHeaders {
+		size := len(ps.spans) + 10
+		newHeaders := make([]header, size)
+		copy(newHeaders, hp.Headers)
+		hp.Headers = newHeaders
+		hp.TotalHeaders = size
+	}
+
+	for h, hs := range ps.spans {
+		value := hs.folded
+		if value == nil {
+			value = hs.value.of(input)
+		}
+
+		name := hs.name.of(input)
+		hp.Headers[h] = header{name, value}
+
+		if id := lookupKnownHeader(name); id >= 0 && hp.known[id] == 0 {
+			hp.known[id] = int32(h + 1)
+		}
+	}
+	hp.NumHeaders = len(ps.spans)
+
+	return n, nil
+}
+
+var (
+	cTransferEncoding = []byte("Transfer-Encoding")
+	cChunked          = []byte("chunked")
+)
+
+// finish runs the checks that need the complete request header.
+func (hp *HTTPParser) finish(n int) (int, error) {
+	if err := hp.readVersion(hp.Version); err != nil {
+		return 0, err
+	}
+
+	if err := hp.readFraming(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+var cHTTPVersionPrefix = []byte("HTTP/")
+
+// readVersion parses an "HTTP/x.y" version into ProtoMajor and ProtoMinor.
+func (hp *headerParser) readVersion(v []byte) error {
+	if len(v) != 8 || !bytes.HasPrefix(v, cHTTPVersionPrefix) ||
+		!isDigit(v[5]) || v[6] != '.' || !isDigit(v[7]) {
+		return errors.Context(ErrBadProto, "invalid http version")
+	}
+
+	hp.ProtoMajor = int(v[5] - '0')
+	hp.ProtoMinor = int(v[7] - '0')
+
+	if hp.ProtoMajor != 1 {
+		return ErrUnsupportedVersion
+	}
+
+	return nil
+}
+
+var (
+	cClose     = []byte("close")
+	cKeepAlive = []byte("keep-alive")
+)
+
+// KeepAlive reports whether the connection may carry another message
+// after this one. HTTP/1.1 connections persist unless "Connection: close"
+// is sent, HTTP/1.0 ones only when "Connection: keep-alive" is.
+func (hp *headerParser) KeepAlive() bool {
+	conn := hp.HeaderValue(HeaderConnection)
+
+	if hp.ProtoMajor == 1 && hp.ProtoMinor == 0 {
+		return hasToken(conn, cKeepAlive)
+	}
+
+	return !hasToken(conn, cClose)
+}
+
+// hasToken reports whether the comma separated list contains token,
+// ignoring case.
+func hasToken(list, token []byte) bool {
+	for len(list) > 0 {
+		var item []byte
+		if i := bytes.IndexByte(list, ','); i != -1 {
+			item, list = list[:i], list[i+1:]
+		} else {
+			item, list = list, nil
+		}
+
+		if bytes.EqualFold(bytes.Trim(item, " \t"), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readFraming works out how the body is delimited.
+func (hp *headerParser) readFraming() error {
+	if hp.Strict {
+		if err := hp.validateFraming(); err != nil {
+			return err
+		}
+	}
+
+	// a sign or an overflow would otherwise pass for a message without
+	// a body, or make BodyReader read a negative size
+	if cl := hp.HeaderValue(HeaderContentLength); cl != nil {
+		if _, ok := parseContentLength(cl); !ok {
+			return errors.Context(ErrBadProto, "invalid content-length")
+		}
+	}
+
+	te := hp.HeaderValue(HeaderTransferEncoding)
+	if te == nil {
+		return nil
+	}
+
+	// Only a lone "chunked" coding is decoded, anything stacked on top of
+	// it (gzip, deflate, ...) would hand the caller a still encoded body.
+	if !bytes.EqualFold(bytes.Trim(te, " \t"), cChunked) {
+		return errors.Context(ErrUnsupported, "transfer-encoding")
+	}
+
+	hp.chunked = true
+	return nil
+}
+
+// Return a value of a header matching name. Well-known headers are
+// answered from the index built during Parse.
+func (hp *headerParser) FindHeader(name []byte) []byte {
+	if id := lookupKnownHeader(name); id >= 0 {
+		return hp.HeaderValue(id)
+	}
+
+	headers := hp.Headers[:hp.NumHeaders]
+
+	for _, header := range headers {
 		if bytes.Equal(header.Name, name) {
 			return header.Value
 		}
 	}
 
-	for _, header := range hp.Headers {
+	for _, header := range headers {
 		if bytes.EqualFold(header.Name, name) {
 			return header.Value
 		}
@@ -258,10 +739,10 @@ func (hp *HTTPParser) FindHeader(name []byte) []byte {
 }
 
 // Return all values of a header matching name.
-func (hp *HTTPParser) FindAllHeaders(name []byte) [][]byte {
+func (hp *headerParser) FindAllHeaders(name []byte) [][]byte {
 	var headers [][]byte
 
-	for _, header := range hp.Headers {
+	for _, header := range hp.Headers[:hp.NumHeaders] {
 		if bytes.EqualFold(header.Name, name) {
 			headers = append(headers, header.Value)
 		}
@@ -270,33 +751,24 @@ func (hp *HTTPParser) FindAllHeaders(name []byte) [][]byte {
 	return headers
 }
 
-var cHost = []byte("Host")
-
 // Return the value of the Host header
 func (hp *HTTPParser) Host() []byte {
-	if hp.hostRead {
-		return hp.host
-	}
-
-	hp.hostRead = true
-	hp.host = hp.FindHeader(cHost)
-	return hp.host
+	return hp.HeaderValue(HeaderHost)
 }
 
 var cContentLength = []byte("Content-Length")
 
 // Return the value of the Content-Length header.
 // A value of -1 indicates the header was not set.
-func (hp *HTTPParser) ContentLength() int64 {
+func (hp *headerParser) ContentLength() int64 {
 	if hp.contentLengthRead {
 		return hp.contentLength
 	}
 
-	header := hp.FindHeader(cContentLength)
+	header := hp.HeaderValue(HeaderContentLength)
 	if header != nil {
-		i, err := strconv.ParseInt(string(header), 10, 0)
-		if err == nil {
-			hp.contentLength = i
+		if n, ok := parseContentLength(header); ok {
+			hp.contentLength = n
 		}
 	}
 
@@ -304,8 +776,25 @@ func (hp *HTTPParser) ContentLength() int64 {
 	return hp.contentLength
 }
 
+// Chunked reports whether the body uses Transfer-Encoding: chunked.
+func (hp *headerParser) Chunked() bool {
+	return hp.chunked
+}
+
+// Return a reader for the request body, or nil if there is none. A chunked
+// body takes precedence over Content-Length as required by RFC 9112
+// section 6.3, and a request with neither has no body.
 func (hp *HTTPParser) BodyReader(rest []byte, in io.ReadCloser) io.ReadCloser {
-	return BodyReader(hp.ContentLength(), rest, in)
+	if hp.chunked {
+		return newChunkedBodyReader(hp.Limits.MaxBodySize, hp.Strict, rest, in)
+	}
+
+	size := hp.ContentLength()
+	if size == -1 {
+		return nil
+	}
+
+	return BodyReader(size, hp.Limits.MaxBodySize, rest, in)
 }
 
 var cGet = []byte("GET")
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+func TestParseChunkedBody(t *testing.T) {
+	req := []byte("POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;name=value\r\nhello\r\n7\r\n, world\r\n0\r\nX-Trailer: yes\r\n\r\n")
+
+	hp := NewHTTPParser()
+	n, err := hp.Parse(req)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if !hp.Chunked() {
+		t.Fatalf("Expected chunked body")
+	}
+
+	body, err := io.ReadAll(hp.BodyReader(req[n:], io.NopCloser(bytes.NewReader(nil))))
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(body) != "hello, world" {
+		t.Errorf("Expected body 'hello, world', got '%s'", body)
+	}
+}
+
+func TestParseUnsupportedTransferEncoding(t *testing.T) {
+	req := []byte("POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+
+	_, err := NewHTTPParser().Parse(req)
+	if !errors.Equal(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestChunkedBodyReaderBadSize(t *testing.T) {
+	br := ChunkedBodyReader(0, []byte("zz\r\nhello\r\n"), io.NopCloser(bytes.NewReader(nil)))
+
+	_, err := io.ReadAll(br)
+	if !errors.Equal(err, ErrBadProto) {
+		t.Errorf("Expected ErrBadProto, got %v", err)
+	}
+}
+
+func TestParseResumable(t *testing.T) {
+	req := []byte("GET /hello HTTP/1.1\r\nHost: example.com\r\nX-Long: a\r\n b\r\nAccept: */*\r\n\r\n")
+
+	hp := NewHTTPParser()
+	for i := 1; i < len(req); i++ {
+		// Hand the parser a fresh copy each time, as gnet may move its buffer.
+		in := append([]byte(nil), req[:i]...)
+		if _, err := hp.Parse(in); err != ErrMissingData {
+			t.Fatalf("Expected ErrMissingData at %d bytes, got %v", i, err)
+		}
+	}
+
+	n, err := hp.Parse(req)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if n != len(req) {
+		t.Errorf("Expected header length %d, got %d", len(req), n)
+	}
+	if string(hp.Path) != "/hello" || string(hp.Version) != "HTTP/1.1" {
+		t.Errorf("Unexpected request line: %s %s %s", hp.Method, hp.Path, hp.Version)
+	}
+	if string(hp.Host()) != "example.com" {
+		t.Errorf("Expected host 'example.com', got '%s'", hp.Host())
+	}
+	if string(hp.FindHeader([]byte("X-Long"))) != "a b" {
+		t.Errorf("Expected folded value 'a b', got '%s'", hp.FindHeader([]byte("X-Long")))
+	}
+}
+
+func TestParseResetBetweenRequests(t *testing.T) {
+	hp := NewHTTPParser()
+
+	first := []byte("POST /a HTTP/1.1\r\nHost: one.com\r\nContent-Length: 5\r\nX-Only-First: 1\r\n\r\n")
+	if _, err := hp.Parse(first); err != nil {
+		t.Fatalf("Failed to parse first request: %v", err)
+	}
+	if hp.ContentLength() != 5 || string(hp.Host()) != "one.com" {
+		t.Fatalf("Unexpected first request: host '%s', length %d", hp.Host(), hp.ContentLength())
+	}
+
+	second := []byte("GET /b HTTP/1.1\r\nHost: two.com\r\n\r\n")
+	if _, err := hp.Parse(second); err != nil {
+		t.Fatalf("Failed to parse second request: %v", err)
+	}
+	if hp.NumHeaders != 1 {
+		t.Errorf("Expected 1 header, got %d", hp.NumHeaders)
+	}
+	if string(hp.Host()) != "two.com" {
+		t.Errorf("Expected host 'two.com', got '%s'", hp.Host())
+	}
+	if hp.ContentLength() != -1 {
+		t.Errorf("Expected no content length, got %d", hp.ContentLength())
+	}
+	if hp.FindHeader([]byte("X-Only-First")) != nil {
+		t.Errorf("Header from the previous request leaked")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 64)
+
+	cases := []struct {
+		name   string
+		limits ParserLimits
+		input  []byte
+		want   error
+	}{
+		{"request line", ParserLimits{MaxRequestLineSize: 32},
+			append(append([]byte("GET /"), long...), " HTTP/1.1\r\n\r\n"...), ErrRequestLineTooLong},
+		{"partial request line", ParserLimits{MaxRequestLineSize: 32},
+			append([]byte("GET /"), long...), ErrRequestLineTooLong},
+		{"header count", ParserLimits{MaxHeaderCount: 2},
+			[]byte("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"), ErrTooManyHeaders},
+		{"header size", ParserLimits{MaxHeaderSize: 32},
+			append(append([]byte("GET / HTTP/1.1\r\nX: "), long...), "\r\n\r\n"...), ErrHeaderTooLarge},
+		{"partial header", ParserLimits{MaxHeaderSize: 32},
+			append([]byte("GET / HTTP/1.1\r\nX: "), long...), ErrHeaderTooLarge},
+		{"header bytes", ParserLimits{MaxHeaderBytes: 40},
+			[]byte("GET / HTTP/1.1\r\nA: 1234567890\r\nB: 1234567890\r\n\r\n"), ErrHeaderBytesTooLarge},
+	}
+
+	for _, c := range cases {
+		hp := NewHTTPParser()
+		hp.Limits = c.limits
+
+		_, err := hp.Parse(c.input)
+		if !errors.Equal(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+
+	// the limit includes the CRLF
+	line := "GET /abcdefgh HTTP/1.1\r\n"
+	for _, max := range []int{len(line), len(line) - 1} {
+		hp := NewHTTPParser()
+		hp.Limits = ParserLimits{MaxRequestLineSize: max}
+		_, err := hp.Parse([]byte(line + "\r\n"))
+		if tooLong := errors.Equal(err, ErrRequestLineTooLong); tooLong != (max < len(line)) {
+			t.Errorf("Expected a %d byte line to be refused only above a limit of %d, got %v", len(line), max, err)
+		}
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	bad := []string{
+		"G@T / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\nHost: a\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a\n\r\n",
+		"GET / HTTP/1.1\r\nBad Name: a\r\n\r\n",
+		"GET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n",
+		"GET / HTTP/1.1\r\nX: a\x00b\r\n\r\n",
+		"GET / HTTP/x\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 5, 5\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+	}
+
+	for _, req := range bad {
+		hp := NewHTTPParser()
+		hp.Strict = true
+
+		if _, err := hp.Parse([]byte(req)); !errors.Equal(err, ErrBadProto) {
+			t.Errorf("Expected ErrBadProto for %q, got %v", req, err)
+		}
+
+		// lax mode keeps accepting what it always did
+		if _, err := NewHTTPParser().Parse([]byte(req)); errors.Equal(err, ErrMissingData) {
+			t.Errorf("Lax parser stalled on %q", req)
+		}
+	}
+
+	hp := NewHTTPParser()
+	hp.Strict = true
+	req := []byte("POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\n")
+	if _, err := hp.Parse(req); err != nil {
+		t.Errorf("Expected valid request to parse, got %v", err)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	hp := NewHTTPParser()
+	req := []byte("GET /a%20b/c?x=1&name=J%C3%B6rg+M&flag&x=2 HTTP/1.1\r\n\r\n")
+	if _, err := hp.Parse(req); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if string(hp.RawPath()) != "/a%20b/c" || string(hp.URLPath()) != "/a b/c" {
+		t.Errorf("Unexpected path: raw '%s', decoded '%s'", hp.RawPath(), hp.URLPath())
+	}
+	if string(hp.RawQuery()) != "x=1&name=J%C3%B6rg+M&flag&x=2" {
+		t.Errorf("Unexpected query '%s'", hp.RawQuery())
+	}
+	if v := hp.QueryArg([]byte("name")); string(v) != "Jörg M" {
+		t.Errorf("Expected name 'Jörg M', got '%s'", v)
+	}
+	if v := hp.QueryArg([]byte("flag")); v == nil || len(v) != 0 {
+		t.Errorf("Expected empty flag value, got %q", v)
+	}
+	if hp.QueryArg([]byte("missing")) != nil {
+		t.Errorf("Expected missing parameter to be nil")
+	}
+
+	var got []string
+	args := hp.QueryArgs()
+	for name, value, ok := args.Next(); ok; name, value, ok = args.Next() {
+		got = append(got, string(name)+"="+string(value))
+	}
+	if want := "x=1 name=Jörg M flag= x=2"; fmt.Sprint(got) != "["+want+"]" {
+		t.Errorf("Expected pairs [%s], got %v", want, got)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		hp.Parse(req)
+		hp.URLPath()
+		hp.QueryArg([]byte("name"))
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+
+	if _, err := hp.Parse([]byte("GET http://example.com/p?q=1 HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if string(hp.URLPath()) != "/p" || string(hp.QueryArg([]byte("q"))) != "1" {
+		t.Errorf("Unexpected absolute-form split: '%s' '%s'", hp.URLPath(), hp.RawQuery())
+	}
+
+	for _, target := range []string{"http://example.com", "HTTPS://example.com:8443?q=1"} {
+		if _, err := hp.Parse([]byte("GET " + target + " HTTP/1.1\r\n\r\n")); err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		if string(hp.URLPath()) != "/" {
+			t.Errorf("Expected '/' for %s, got '%s'", target, hp.URLPath())
+		}
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	resp := []byte("HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\nnot found")
+
+	rp := NewHTTPResponseParser()
+	n, err := rp.Parse(resp)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if string(rp.Version) != "HTTP/1.1" || rp.StatusCode != 404 || string(rp.Reason) != "Not Found" {
+		t.Errorf("Unexpected status line: %s %d %s", rp.Version, rp.StatusCode, rp.Reason)
+	}
+	if string(rp.FindHeader([]byte("content-type"))) != "text/plain" {
+		t.Errorf("Unexpected content type '%s'", rp.FindHeader([]byte("content-type")))
+	}
+
+	body, err := io.ReadAll(rp.BodyReader(resp[n:], io.NopCloser(bytes.NewReader(nil))))
+	if err != nil || string(body) != "not found" {
+		t.Errorf("Unexpected body '%s': %v", body, err)
+	}
+
+	if _, err := rp.Parse([]byte("HTTP/1.1 204\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if rp.StatusCode != 204 || len(rp.Reason) != 0 || rp.BodyReader(nil, nil) != nil {
+		t.Errorf("Expected bodiless 204 without reason, got %d '%s'", rp.StatusCode, rp.Reason)
+	}
+
+	for _, bad := range []string{"HTTP/1.1 20 OK\r\n\r\n", "HTTP/1.1 2000 OK\r\n\r\n", "HTTP/1.1 abc OK\r\n\r\n"} {
+		if _, err := rp.Parse([]byte(bad)); !errors.Equal(err, ErrBadProto) {
+			t.Errorf("Expected ErrBadProto for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestParseKnownHeaders(t *testing.T) {
+	hp := NewHTTPParser()
+	req := []byte("GET / HTTP/1.1\r\nhost: a.com\r\nX-Custom: 1\r\nCOOKIE: s=1\r\nCookie: s=2\r\n\r\n")
+	if _, err := hp.Parse(req); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if string(hp.HeaderValue(HeaderHost)) != "a.com" {
+		t.Errorf("Expected host 'a.com', got '%s'", hp.HeaderValue(HeaderHost))
+	}
+	if string(hp.FindHeader([]byte("Cookie"))) != "s=1" {
+		t.Errorf("Expected first cookie 's=1', got '%s'", hp.FindHeader([]byte("Cookie")))
+	}
+	if len(hp.FindAllHeaders([]byte("cookie"))) != 2 {
+		t.Errorf("Expected both cookie headers")
+	}
+	if hp.HeaderValue(HeaderContentType) != nil {
+		t.Errorf("Expected no content type")
+	}
+	if string(hp.FindHeader([]byte("x-custom"))) != "1" {
+		t.Errorf("Expected custom header '1', got '%s'", hp.FindHeader([]byte("x-custom")))
+	}
+}
+
+func BenchmarkParsePipelined(b *testing.B) {
+	req := []byte("GET /hello HTTP/1.1\r\nHost: example.com\r\nUser-Agent: bench\r\nAccept: */*\r\n" +
+		"Connection: keep-alive\r\nContent-Length: 0\r\n\r\n")
+	hp := NewHTTPParser()
+
+	for i := 0; i < b.N; i++ {
+		hp.Parse(req)
+		hp.Host()
+		hp.ContentLength()
+		hp.HeaderValue(HeaderConnection)
+	}
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	cases := []struct {
+		req          string
+		major, minor int
+		keepAlive    bool
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", 1, 1, true},
+		{"GET / HTTP/1.1\r\nConnection: Upgrade, close\r\n\r\n", 1, 1, false},
+		{"GET / HTTP/1.0\r\n\r\n", 1, 0, false},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", 1, 0, true},
+	}
+
+	hp := NewHTTPParser()
+	for _, c := range cases {
+		if _, err := hp.Parse([]byte(c.req)); err != nil {
+			t.Fatalf("Failed to parse %q: %v", c.req, err)
+		}
+		if hp.ProtoMajor != c.major || hp.ProtoMinor != c.minor || hp.KeepAlive() != c.keepAlive {
+			t.Errorf("%q: expected %d.%d keep-alive %t, got %d.%d keep-alive %t", c.req,
+				c.major, c.minor, c.keepAlive, hp.ProtoMajor, hp.ProtoMinor, hp.KeepAlive())
+		}
+	}
+
+	if _, err := hp.Parse([]byte("GET / HTTP/2.0\r\n\r\n")); !errors.Equal(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	hp := NewHTTPParser()
+	req := []byte("GET / HTTP/1.1\r\nCookie: session=abc; theme=\"dark\"; junk\r\nCookie: lang=en\r\n\r\n")
+	if _, err := hp.Parse(req); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	var got []string
+	cs := hp.Cookies()
+	for name, value, ok := cs.Next(); ok; name, value, ok = cs.Next() {
+		got = append(got, string(name)+"="+string(value))
+	}
+	if fmt.Sprint(got) != "[session=abc theme=dark lang=en]" {
+		t.Errorf("Unexpected cookies %v", got)
+	}
+	if string(hp.Cookie([]byte("lang"))) != "en" || hp.Cookie([]byte("missing")) != nil {
+		t.Errorf("Unexpected cookie lookup")
+	}
+
+	sc := SetCookie{
+		Name:     "session",
+		Value:    "abc",
+		Path:     "/",
+		MaxAge:   3600,
+		Expires:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: SameSiteLax,
+	}
+	line, err := sc.AppendTo(nil)
+	want := "session=abc; Path=/; Max-Age=3600; Expires=Wed, 01 May 2024 12:00:00 GMT; Secure; HttpOnly; SameSite=Lax"
+	if err != nil || string(line) != want {
+		t.Errorf("Expected '%s', got '%s' (%v)", want, line, err)
+	}
+
+	sc = SetCookie{Name: "a", Value: "x\r\nInjected: 1"}
+	if _, err := sc.AppendTo(nil); !errors.Equal(err, ErrBadCookie) {
+		t.Errorf("Expected ErrBadCookie, got %v", err)
+	}
+}
+
+func TestChunkScanner(t *testing.T) {
+	body := []byte("5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\nX-Trailer: yes\r\n\r\nNEXT")
+	end := len(body) - len("NEXT")
+
+	var cs chunkScanner
+	for i := 0; i < end; i++ {
+		if _, err := cs.scan(body[:i]); err != ErrMissingData {
+			t.Fatalf("Expected ErrMissingData at %d bytes, got %v", i, err)
+		}
+	}
+
+	n, err := cs.scan(body)
+	if err != nil || n != end {
+		t.Errorf("Expected body length %d, got %d (%v)", end, n, err)
+	}
+}
+
+func TestChunkedStrict(t *testing.T) {
+	lenient := []string{
+		"5\nhello\r\n0\r\n\r\n",
+		"5\r\nhello\n0\r\n\r\n",
+		"5\r\nhello\r\n0\r\n\n",
+		"5 ;ext\r\nhello\r\n0\r\n\r\n",
+		"5 \r\nhello\r\n0\r\n\r\n",
+	}
+	empty := io.NopCloser(bytes.NewReader(nil))
+
+	for _, body := range lenient {
+		var cs chunkScanner
+		cs.reset(0, false)
+		if n, err := cs.scan([]byte(body)); err != nil || n != len(body) {
+			t.Errorf("Lax scanner: expected %q to be accepted, got %d (%v)", body, n, err)
+		}
+		cs.reset(0, true)
+		if _, err := cs.scan([]byte(body)); !errors.Equal(err, ErrBadProto) {
+			t.Errorf("Strict scanner: expected ErrBadProto for %q, got %v", body, err)
+		}
+
+		if b, err := io.ReadAll(newChunkedBodyReader(0, false, []byte(body), empty)); err != nil || string(b) != "hello" {
+			t.Errorf("Lax reader: expected hello from %q, got %q (%v)", body, b, err)
+		}
+		if _, err := io.ReadAll(newChunkedBodyReader(0, true, []byte(body), empty)); !errors.Equal(err, ErrBadProto) {
+			t.Errorf("Strict reader: expected ErrBadProto for %q, got %v", body, err)
+		}
+	}
+}
+
+func TestCodecFrame(t *testing.T) {
+	req := []byte("POST /upload HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc")
+	first := bytes.Index(req, []byte("POST /b"))
+
+	hc := &httpCodec{parser: NewHTTPParser()}
+	for i := 1; i < first; i++ {
+		// a fresh copy per event, as gnet may move the bytes
+		if _, err := hc.frame(append([]byte(nil), req[:i]...)); err != ErrMissingData {
+			t.Fatalf("Expected ErrMissingData at %d bytes, got %v", i, err)
+		}
+		hc.stale = hc.headerLen > 0
+	}
+
+	n, err := hc.frame(req)
+	if err != nil || n != first {
+		t.Fatalf("Expected first request of %d bytes, got %d (%v)", first, n, err)
+	}
+	body, _ := io.ReadAll(hc.bodyReader())
+	if string(hc.parser.Path) != "/upload" || string(body) != "hello" {
+		t.Errorf("Unexpected first request %s '%s'", hc.parser.Path, body)
+	}
+
+	n, err = hc.frame(req[first:])
+	if err != nil || n != len(req)-first || string(hc.body) != "abc" {
+		t.Errorf("Unexpected second request: %d '%s' (%v)", n, hc.body, err)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestSizedBodyReader(t *testing.T) {
+	conn := &closeRecorder{Reader: bytes.NewReader([]byte(" world!NEXT"))}
+	br := BodyReader(11, 0, []byte("hello"), conn)
+
+	// a buffer smaller than the body used to panic
+	var got []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := br.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+	}
+	if string(got) != "hello world" {
+		t.Errorf("Expected 'hello world', got '%s'", got)
+	}
+
+	rest, _ := io.ReadAll(conn.Reader)
+	if string(rest) != "!NEXT" {
+		t.Errorf("Body reader consumed past its end, left '%s'", rest)
+	}
+
+	// a negative size used to panic on the first Read
+	br = BodyReader(-5, 0, []byte("hello"), io.NopCloser(bytes.NewReader(nil)))
+	if _, err := br.Read(buf); !errors.Equal(err, ErrBadProto) {
+		t.Errorf("Expected ErrBadProto for a negative size, got %v", err)
+	}
+}
+
+func TestParseInvalidContentLength(t *testing.T) {
+	for _, cl := range []string{"-5", "+5", "5 5", "0x5", "99999999999999999999"} {
+		req := []byte("POST / HTTP/1.1\r\nContent-Length: " + cl + "\r\n\r\nhello")
+		hp := NewHTTPParser()
+		if _, err := hp.Parse(req); !errors.Equal(err, ErrBadProto) {
+			t.Errorf("Expected ErrBadProto for Content-Length %q, got %v", cl, err)
+		}
+	}
+}
+
+func TestBodyReaderDrainOnClose(t *testing.T) {
+	conn := &closeRecorder{Reader: bytes.NewReader([]byte("defNEXT"))}
+	br := BodyReader(6, 0, []byte("abc"), conn)
+
+	if err := br.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if conn.closed {
+		t.Errorf("Close of a drained body closed the connection")
+	}
+	if rest, _ := io.ReadAll(conn.Reader); string(rest) != "NEXT" {
+		t.Errorf("Expected connection at 'NEXT', got '%s'", rest)
+	}
+
+	conn = &closeRecorder{Reader: bytes.NewReader(nil)}
+	br = BodyReader(6, 0, []byte("abc"), conn)
+	if err := br.Close(); err == nil || !conn.closed {
+		t.Errorf("Expected truncated body to close the connection, got %v", err)
+	}
+}
+
+func TestBodyReaderMaxSize(t *testing.T) {
+	empty := io.NopCloser(bytes.NewReader(nil))
+
+	if _, err := io.ReadAll(BodyReader(10, 5, []byte("0123456789"), empty)); !errors.Equal(err, ErrBodyTooLarge) {
+		t.Errorf("Sized: expected ErrBodyTooLarge, got %v", err)
+	}
+
+	body, err := io.ReadAll(BodyReader(-1, 5, []byte("01234"), empty))
+	if err != nil || string(body) != "01234" {
+		t.Errorf("Unsized at the limit: got '%s' (%v)", body, err)
+	}
+	if _, err := io.ReadAll(BodyReader(-1, 5, []byte("012345"), empty)); !errors.Equal(err, ErrBodyTooLarge) {
+		t.Errorf("Unsized: expected ErrBodyTooLarge, got %v", err)
+	}
+
+	chunked := []byte("3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n")
+	if _, err := io.ReadAll(ChunkedBodyReader(5, chunked, empty)); !errors.Equal(err, ErrBodyTooLarge) {
+		t.Errorf("Chunked: expected ErrBodyTooLarge, got %v", err)
+	}
+
+	var cs chunkScanner
+	cs.reset(5, false)
+	if _, err := cs.scan(chunked); !errors.Equal(err, ErrBodyTooLarge) {
+		t.Errorf("Scanner: expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestMultipartReader(t *testing.T) {
+	file := bytes.Repeat([]byte("0123456789"), 2000)
+	body := "preamble\r\n--XyZ\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n" +
+		"--XyZ\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"a;b.txt\"\r\nContent-Type: text/plain\r\n\r\n" +
+		string(file) + "\r\n--XyZ--\r\nepilogue"
+	req := []byte("POST /form HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=XyZ\r\n\r\n")
+
+	hp := NewHTTPParser()
+	if _, err := hp.Parse(req); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	// a reader handing out tiny reads, so delimiters straddle buffer fills
+	mr, err := hp.MultipartReader(iotest.OneByteReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+
+	part, err := mr.NextPart()
+	if err != nil || string(part.FormName()) != "title" || part.FileName() != nil {
+		t.Fatalf("Unexpected first part %q: %v", part.FormName(), err)
+	}
+	if v, _ := io.ReadAll(part); string(v) != "hello" {
+		t.Errorf("Expected 'hello', got '%s'", v)
+	}
+
+	part, err = mr.NextPart()
+	if err != nil || string(part.FormName()) != "upload" || string(part.FileName()) != "a;b.txt" {
+		t.Fatalf("Unexpected second part %q %q: %v", part.FormName(), part.FileName(), err)
+	}
+	if string(part.HeaderValue(HeaderContentType)) != "text/plain" {
+		t.Errorf("Unexpected part content type '%s'", part.HeaderValue(HeaderContentType))
+	}
+	if v, _ := io.ReadAll(part); !bytes.Equal(v, file) {
+		t.Errorf("File part mismatch, got %d bytes", len(v))
+	}
+
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	mr, _ = hp.MultipartReader(strings.NewReader(body))
+	mr.Limits.MaxPartSize = 100
+	mr.NextPart()
+	if part, err = mr.NextPart(); err != nil {
+		t.Fatalf("Failed to skip to the file part: %v", err)
+	}
+	if _, err := io.ReadAll(part); !errors.Equal(err, ErrPartTooLarge) {
+		t.Errorf("Expected ErrPartTooLarge, got %v", err)
+	}
+
+	mr, _ = hp.MultipartReader(strings.NewReader(body))
+	mr.Limits.MaxParts = 1
+	mr.NextPart()
+	if _, err := mr.NextPart(); !errors.Equal(err, ErrTooManyParts) {
+		t.Errorf("Expected ErrTooManyParts, got %v", err)
+	}
+}
+
+func TestReadForm(t *testing.T) {
+	req := []byte("POST /save?id=q&page=2 HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded; charset=utf-8\r\n" +
+		"Content-Length: 30\r\n\r\nid=f&name=a+b%21&tags=x&tags=y")
+
+	hp := NewHTTPParser()
+	n, err := hp.Parse(req)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if err := hp.ReadForm(hp.BodyReader(req[n:], NoBody)); err != nil {
+		t.Fatalf("Failed to read form: %v", err)
+	}
+	if string(hp.FormValue([]byte("name"))) != "a b!" {
+		t.Errorf("Expected 'a b!', got '%s'", hp.FormValue([]byte("name")))
+	}
+
+	hp.AddPathParam([]byte("id"), []byte("p"))
+	for name, want := range map[string]string{"id": "p", "page": "2", "tags": "x"} {
+		if got := hp.Param([]byte(name)); string(got) != want {
+			t.Errorf("Param %s: expected '%s', got '%s'", name, want, got)
+		}
+	}
+
+	body := bytes.NewReader(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		hp.Parse(req)
+		body.Reset(req[n:])
+		hp.ReadForm(body)
+		hp.Param([]byte("name"))
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+
+	hp.Limits.MaxFormSize = 10
+	hp.Parse(req)
+	if err := hp.ReadForm(bytes.NewReader(req[n:])); !errors.Equal(err, ErrBodyTooLarge) {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+
+	hp.Parse([]byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\n\r\n"))
+	if err := hp.ReadForm(nil); !errors.Equal(err, ErrNotForm) {
+		t.Errorf("Expected ErrNotForm, got %v", err)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	req := []byte("POST /users/7?x=1 HTTP/1.1\r\nhost: example.com\r\nx-token: a\r\nX-Token: b\r\n" +
+		"Content-Length: 5\r\nConnection: close\r\n\r\nhello")
+
+	hp := NewHTTPParser()
+	n, err := hp.Parse(req)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	r, err := hp.NewRequest(hp.BodyReader(req[n:], NoBody))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if r.Method != "POST" || r.URL.Path != "/users/7" || r.URL.Query().Get("x") != "1" {
+		t.Errorf("Expected POST /users/7?x=1, got %s %s", r.Method, r.URL)
+	}
+	if r.Host != "example.com" || r.Header.Get("Host") != "" {
+		t.Errorf("Expected host only in r.Host, got '%s' and '%s'", r.Host, r.Header.Get("Host"))
+	}
+	if got := r.Header["X-Token"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Expected X-Token [a b], got %v", got)
+	}
+	if r.ContentLength != 5 || !r.Close || r.ProtoMinor != 1 {
+		t.Errorf("Expected length 5, close, HTTP/1.1, got %d, %t, %s", r.ContentLength, r.Close, r.Proto)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != "hello" {
+		t.Errorf("Expected body 'hello', got '%s'", body)
+	}
+
+	hp.Parse([]byte("GET http://other.org/a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	r, _ = hp.NewRequest(nil)
+	if r.Host != "other.org" || r.Body != http.NoBody {
+		t.Errorf("Expected absolute-form host and no body, got '%s'", r.Host)
+	}
+}
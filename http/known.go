@@ -0,0 +1,65 @@
+package main
+
+import "bytes"
+
+// HeaderID names a well-known header. The parser records where each one
+// is while parsing, so looking them up costs no scan of Headers.
+type HeaderID int
+
+const (
+	HeaderHost HeaderID = iota
+	HeaderContentLength
+	HeaderTransferEncoding
+	HeaderConnection
+	HeaderContentType
+	HeaderContentDisposition
+	HeaderCookie
+	HeaderExpect
+	HeaderUpgrade
+	HeaderAccept
+	HeaderAcceptEncoding
+	HeaderAuthorization
+	HeaderUserAgent
+	HeaderSetCookie
+	HeaderLocation
+
+	numKnownHeaders
+)
+
+var knownHeaders = [numKnownHeaders][]byte{
+	HeaderHost:               []byte("Host"),
+	HeaderContentLength:      []byte("Content-Length"),
+	HeaderTransferEncoding:   []byte("Transfer-Encoding"),
+	HeaderConnection:         []byte("Connection"),
+	HeaderContentType:        []byte("Content-Type"),
+	HeaderContentDisposition: []byte("Content-Disposition"),
+	HeaderCookie:             []byte("Cookie"),
+	HeaderExpect:             []byte("Expect"),
+	HeaderUpgrade:            []byte("Upgrade"),
+	HeaderAccept:             []byte("Accept"),
+	HeaderAcceptEncoding:     []byte("Accept-Encoding"),
+	HeaderAuthorization:      []byte("Authorization"),
+	HeaderUserAgent:          []byte("User-Agent"),
+	HeaderSetCookie:          []byte("Set-Cookie"),
+	HeaderLocation:           []byte("Location"),
+}
+
+// lookupKnownHeader returns the HeaderID of name, or -1.
+func lookupKnownHeader(name []byte) HeaderID {
+	for id, k := range knownHeaders {
+		if len(k) == len(name) && bytes.EqualFold(k, name) {
+			return HeaderID(id)
+		}
+	}
+
+	return -1
+}
+
+// Return the value of the first occurrence of a well-known header, or nil.
+func (hp *headerParser) HeaderValue(id HeaderID) []byte {
+	if i := hp.known[id]; i > 0 {
+		return hp.Headers[i-1].Value
+	}
+
+	return nil
+}
@@ -2,27 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"sync/atomic"
+	"net/http"
+	"sync"
 	"time"
 
 	cxstrconv "github.com/cloudxaas/gostrconv"
 	"github.com/leslie-fei/gnettls"
 
 	//    cxsysinfomem "github.com/cloudxaas/gosysinfo/mem"
-	"github.com/evanphx/wildcat"
 	"github.com/leslie-fei/gnettls/tls"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/valyala/bytebufferpool"
+	"github.com/vektra/errors"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
+	"gnet-example/timewheel"
 )
 
 var (
-	errMsg         = "Internal Server Error"
-	errMsgBytes    = []byte(errMsg)
-	now            atomic.Value
-	bufferPool     bytebufferpool.Pool
-	responseHeader = []byte("HTTP/1.1 200 OK\r\nServer: gnet\r\nContent-Type: text/plain\r\nDate: ")
+	continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+	bufferPool       bytebufferpool.Pool
+	responseHeader   = []byte("HTTP/1.1 200 OK\r\nServer: gnet\r\nContent-Type: text/plain\r\nDate: ")
 )
 
 type httpServer struct {
@@ -30,71 +36,490 @@ type httpServer struct {
 	addr      string
 	multicore bool
 	eng       gnet.Engine
+
+	// expect decides on a request sent with "Expect: 100-continue" as
+	// soon as its header is in, before the client sends the body. It
+	// returns StatusContinue to accept or the final status to refuse with.
+	// nil accepts every request.
+	expect func(hp *HTTPParser) int
+
+	// errorPage writes the response to a request that could not be
+	// parsed, code being the status picked by parseErrorStatus. It builds
+	// the page like a handler would; the connection is closed after it
+	// whatever the page says. nil sends a bodiless response.
+	errorPage func(hc *httpCodec, code int, err error)
+
+	// router serves every request, usually a *Router but any Handler
+	// will do
+	router Handler
+
+	// maxPipelined caps the pipelined requests answered in one event on a
+	// connection, so a client sending many at once cannot hold the event
+	// loop or pile up responses. The rest stay in the inbound buffer until
+	// the next event. 0 means DefaultMaxPipelined.
+	maxPipelined int
+
+	// timeouts close slow or idle connections; wheel, advanced by OnTick,
+	// runs them. A nil wheel disables every timeout.
+	timeouts Timeouts
+	wheel    *timewheel.Wheel
+
+	// handler serves every request in place of router when set, so
+	// existing net/http handlers run unchanged on the event loop.
+	handler http.Handler
+
+	// drain and conns let Shutdown close every connection once it has
+	// answered the requests it already sent
+	drain graceful.Drainer
+	conns sync.Map // gnet.Conn -> *httpCodec
 }
 
+// DefaultMaxPipelined is the default for httpServer.maxPipelined.
+const DefaultMaxPipelined = 32
+
+// Timeouts bound how long a connection may take in each phase of a
+// request, so slowloris-style clients cannot pin connections open. Each
+// one runs from the start of its phase, not from the last byte received.
+// Zero disables a timeout.
+type Timeouts struct {
+	Header time.Duration // from the first byte of a request to the end of its header
+	Body   time.Duration // from the end of the header to the end of the body
+	Idle   time.Duration // between requests on a keep-alive connection
+}
+
+var DefaultTimeouts = Timeouts{
+	Header: 10 * time.Second,
+	Body:   60 * time.Second,
+	Idle:   90 * time.Second,
+}
+
+// connection phases a timeout applies to
+const (
+	phaseHeader = iota
+	phaseBody
+	phaseIdle
+)
+
 type httpCodec struct {
-	parser *wildcat.HTTPParser
+	parser *HTTPParser
 	buf    *bytebufferpool.ByteBuffer // Main buffer reused for all I/O operations
+	header []byte                     // extra header lines of the next response
+
+	// framing of the request being received, kept across OnTraffic calls
+	headerLen int // 0 while the header is still incomplete
+	bodyLen   int // declared body size, -1 for a chunked body
+	chunks    chunkScanner
+	stale     bool // parser slices point into an earlier event's buffer
+	expect    bool // the header just parsed carries an Expect header
+	body      []byte
+
+	close  bool            // end the connection after the current response
+	writer *responseWriter // reused by serveHTTP
+
+	phase   int // which timeout is running
+	timer   *timewheel.Timer
+	pending bool // part of a request is buffered
+
+	// response being built by the handler, see setStatus and Write
+	status      int
+	contentType string
+	writing     bool // the body is being written into buf from bodyStart
+	bodyStart   int
+	responded   bool   // the response was appended in one go
+	sent        int    // status of the response already appended, see statusCode
+	head        []byte // scratch for the header of a built response
 }
 
 type combinedContext struct {
 	httpCodec *httpCodec
 }
 
-func updateCurrentTime() {
-	now.Store(time.Now().Format(time.RFC1123))
+// frame returns the size of the request at the start of data, header and
+// body, once all of it has arrived, and ErrMissingData until then.
+func (hc *httpCodec) frame(data []byte) (int, error) {
+	if hc.headerLen == 0 {
+		n, err := hc.parser.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		max := hc.parser.Limits.MaxBodySize
+		hc.bodyLen = 0
+		if hc.parser.Chunked() {
+			hc.bodyLen = -1
+			hc.chunks.reset(max, hc.parser.Strict)
+		} else if cl := hc.parser.ContentLength(); cl > 0 {
+			// refuse before buffering rather than after
+			if max > 0 && cl > max {
+				return 0, ErrBodyTooLarge
+			}
+			hc.bodyLen = int(cl)
+		}
+		hc.headerLen = n
+		// HTTP/1.0 clients do not know about 100 Continue
+		hc.expect = hc.parser.ProtoMinor > 0 && hc.parser.HeaderValue(HeaderExpect) != nil
+	}
+
+	bodyLen := hc.bodyLen
+	if bodyLen == -1 {
+		n, err := hc.chunks.scan(data[hc.headerLen:])
+		if err != nil {
+			return 0, err
+		}
+		bodyLen = n
+	}
+
+	total := hc.headerLen + bodyLen
+	if total > len(data) {
+		return 0, ErrMissingData
+	}
+
+	if hc.stale {
+		// gnet may have moved the bytes since the header was parsed
+		if _, err := hc.parser.Parse(data); err != nil {
+			return 0, err
+		}
+		hc.stale = false
+	}
+
+	hc.body = data[hc.headerLen:total]
+	hc.headerLen = 0
+	return total, nil
+}
+
+// bodyReader returns the body of the request being served, or nil.
+func (hc *httpCodec) bodyReader() io.ReadCloser {
+	return hc.parser.BodyReader(hc.body, NoBody)
+}
+
+// appendError writes a bodiless final response that ends the connection.
+func (hc *httpCodec) appendError(code int) {
+	hc.discardResponse()
+	hc.buf.B = AppendStatusLine(hc.buf.B, code)
+	hc.buf.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	hc.responded = true
+	hc.sent = code
 }
 
+// setStatus sets the status code of the response, StatusOK by default.
+func (hc *httpCodec) setStatus(code int) {
+	hc.status = code
+}
+
+// statusCode returns the status of the response to the current request,
+// whether it was already appended or is still being built.
+func (hc *httpCodec) statusCode() int {
+	switch {
+	case hc.status != 0:
+		return hc.status
+	case hc.sent != 0:
+		return hc.sent
+	}
+	return StatusOK
+}
+
+// setContentType sets the Content-Type of the response, text/plain by
+// default.
+func (hc *httpCodec) setContentType(contentType string) {
+	hc.contentType = contentType
+}
+
+// addHeader adds a header line to the response. CR and LF are replaced so
+// a value cannot split the response.
+func (hc *httpCodec) addHeader(name, value string) {
+	hc.header = appendNoNewline(hc.header, name)
+	hc.header = append(hc.header, ": "...)
+	hc.header = appendNoNewline(hc.header, value)
+	hc.header = append(hc.header, "\r\n"...)
+}
+
+// setCookie adds a Set-Cookie header to the next response.
+func (hc *httpCodec) setCookie(sc *SetCookie) error {
+	line := append(hc.header, "Set-Cookie: "...)
+	line, err := sc.AppendTo(line)
+	if err != nil {
+		return err
+	}
+	hc.header = append(line, "\r\n"...)
+	return nil
+}
+
+// Write appends p to the body of the response. The body goes straight
+// into the connection buffer; the header is put in front of it once the
+// handler returns.
+func (hc *httpCodec) Write(p []byte) (int, error) {
+	hc.startBody()
+	hc.buf.B = append(hc.buf.B, p...)
+	return len(p), nil
+}
+
+func (hc *httpCodec) WriteString(s string) (int, error) {
+	hc.startBody()
+	hc.buf.B = append(hc.buf.B, s...)
+	return len(s), nil
+}
+
+func (hc *httpCodec) startBody() {
+	if !hc.writing {
+		hc.writing = true
+		hc.bodyStart = len(hc.buf.B)
+	}
+}
+
+// appendHeader appends the status line and header of the response.
+func (hc *httpCodec) appendHeader(dst []byte, bodyLen int) []byte {
+	status := hc.status
+	if status == 0 {
+		status = StatusOK
+	}
+	hc.sent = status
+
+	if status == StatusOK && hc.contentType == "" {
+		dst = append(dst, responseHeader...)
+	} else {
+		dst = AppendStatusLine(dst, status)
+		dst = append(dst, "Server: gnet\r\n"...)
+		if bodyAllowedForStatus(status) {
+			dst = append(dst, "Content-Type: "...)
+			if hc.contentType == "" {
+				dst = append(dst, "text/plain"...)
+			} else {
+				dst = appendNoNewline(dst, hc.contentType)
+			}
+			dst = append(dst, "\r\n"...)
+		}
+		dst = append(dst, "Date: "...)
+	}
+	dst = append(dst, httpdate.Load()...)
+	if bodyAllowedForStatus(status) {
+		dst = append(dst, "\r\nContent-Length: "...)
+		dst = append(dst, cxstrconv.Inttoa(bodyLen)...)
+	}
+	switch {
+	case !hc.parser.KeepAlive() || hc.close:
+		dst = append(dst, "\r\nConnection: close"...)
+	case hc.parser.ProtoMinor == 0:
+		// HTTP/1.0 clients only keep the connection when told so
+		dst = append(dst, "\r\nConnection: keep-alive"...)
+	}
+	dst = append(dst, "\r\n"...)
+	dst = append(dst, hc.header...)
+	return append(dst, "\r\n"...)
+}
+
+// appendResponse writes the whole response with body at once.
 func (hc *httpCodec) appendResponse(body []byte) {
-	updateCurrentTime() // Update time only when responding
-	hc.buf.Write(responseHeader)
-	hc.buf.WriteString(now.Load().(string))
-	hc.buf.WriteString("\r\nContent-Length: ")
-	hc.buf.WriteString(cxstrconv.Inttoa(len(body)))
-	hc.buf.WriteString("\r\n\r\n")
-	hc.buf.Write(body)
+	if hc.writing {
+		hc.Write(body)
+		return
+	}
+	hc.buf.B = hc.appendHeader(hc.buf.B, len(body))
+	if hc.sendBody() {
+		hc.buf.Write(body)
+	}
+	hc.discardResponse()
+	hc.responded = true
+}
+
+// appendStatus writes a response with the reason phrase of code as its
+// body. Whatever the handler already wrote is dropped, typically on an
+// error path.
+func (hc *httpCodec) appendStatus(code int) {
+	if hc.writing {
+		hc.buf.B = hc.buf.B[:hc.bodyStart]
+		hc.writing = false
+	}
+	text := StatusText(code)
+	hc.status = code
+	hc.buf.B = hc.appendHeader(hc.buf.B, len(text))
+	if hc.sendBody() {
+		hc.buf.WriteString(text)
+	}
+	hc.discardResponse()
+	hc.responded = true
+}
+
+// finishResponse completes the response the handler built with setStatus,
+// addHeader and Write, or sends an empty 200 if it wrote nothing.
+func (hc *httpCodec) finishResponse() {
+	if hc.responded {
+		hc.responded = false
+		return
+	}
+	hc.startBody()
+	start := hc.bodyStart
+	n := len(hc.buf.B) - start
+	hc.head = hc.appendHeader(hc.head[:0], n)
+	// make room and move the body behind its header
+	hc.buf.B = append(hc.buf.B, hc.head...)
+	copy(hc.buf.B[start+len(hc.head):], hc.buf.B[start:start+n])
+	copy(hc.buf.B[start:], hc.head)
+	if !hc.sendBody() {
+		hc.buf.B = hc.buf.B[:start+len(hc.head)]
+	}
+	hc.discardResponse()
+}
+
+// sendBody reports whether the body of the response goes on the wire.
+func (hc *httpCodec) sendBody() bool {
+	return bodyAllowedForStatus(hc.status) && !bytes.Equal(hc.parser.Method, cHEAD)
+}
+
+// discardResponse drops the state of the response being built.
+func (hc *httpCodec) discardResponse() {
+	hc.status = 0
+	hc.contentType = ""
+	hc.header = hc.header[:0]
+	hc.writing = false
 }
 
+var cHEAD = []byte("HEAD")
+
 func (hs *httpServer) OnBoot(eng gnet.Engine) gnet.Action {
 	hs.eng = eng
+	if hs.wheel == nil && hs.timeouts != (Timeouts{}) {
+		// OnTick advances it once per second
+		hs.wheel = timewheel.New(time.Second, 128)
+	}
 	log.Printf("HTTP server with multi-core=%t is listening on %s\n", hs.multicore, hs.addr)
 	return gnet.None
 }
 
+// OnTick refreshes the cached Date header and expires timeouts at every
+// second.
+func (hs *httpServer) OnTick() (time.Duration, gnet.Action) {
+	if hs.wheel != nil {
+		hs.wheel.Advance()
+	}
+	return httpdate.Tick(), gnet.None
+}
+
+// enterPhase restarts the timeout of hc for phase.
+func (hs *httpServer) enterPhase(hc *httpCodec, phase int) {
+	hc.phase = phase
+	if hs.wheel == nil {
+		return
+	}
+
+	var d time.Duration
+	switch phase {
+	case phaseHeader:
+		d = hs.timeouts.Header
+	case phaseBody:
+		d = hs.timeouts.Body
+	case phaseIdle:
+		d = hs.timeouts.Idle
+	}
+	if d > 0 {
+		hs.wheel.Reset(hc.timer, d)
+	} else {
+		hs.wheel.Stop(hc.timer)
+	}
+}
+
 func (hs *httpServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	if hs.drain.Draining() {
+		return nil, gnet.Close
+	}
+
 	hc := &httpCodec{
-		parser: wildcat.NewHTTPParser(),
+		parser: NewHTTPParser(),
 		buf:    bytebufferpool.Get(),
 	}
+	// we are deployed behind proxies, refuse anything ambiguous
+	hc.parser.Strict = true
 	c.SetContext(&combinedContext{
 		httpCodec: hc,
 	})
+	if hs.wheel != nil {
+		hc.timer = timewheel.NewTimer(func() { _ = c.Close() })
+		// a client that connects must send its request promptly
+		hs.enterPhase(hc, phaseHeader)
+	}
+	hs.drain.Open()
+	hs.conns.Store(c, hc)
 	return nil, gnet.None
 }
 
 func (hs *httpServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	// gnettls hands over the raw connection, whose context is the TLS
+	// connection OnOpen saw
+	if tc, ok := c.Context().(gnet.Conn); ok {
+		c = tc
+	}
 	ctx, ok := c.Context().(*combinedContext)
 	if ok && ctx.httpCodec != nil {
 		bufferPool.Put(ctx.httpCodec.buf)
+		if hs.wheel != nil {
+			hs.wheel.Stop(ctx.httpCodec.timer)
+		}
+		hs.conns.Delete(c)
+		hs.drain.Close()
 	}
 	return gnet.None
 }
 
-func route(hc *httpCodec) {
-	var response []byte
-	if bytes.Equal(hc.parser.Method, []byte("GET")) {
-		switch {
-		case bytes.Equal(hc.parser.Path, []byte("/hello")):
-			response = []byte("Hello, World!")
-		case bytes.Equal(hc.parser.Path, []byte("/time")):
-			response = []byte("Current Time: " + now.Load().(string))
-		default:
-			response = []byte("404 Not Found")
-		}
-	} else {
-		response = []byte("405 Method Not Allowed")
+func newRouter() *Router {
+	r := NewRouter()
+	r.Handle("GET", "/hello", func(hc *httpCodec) {
+		hc.appendResponse([]byte("Hello, World!"))
+	})
+	r.Handle("GET", "/time", func(hc *httpCodec) {
+		hc.WriteString("Current Time: ")
+		hc.Write(httpdate.Load())
+	})
+	return r
+}
+
+// parseErrorStatus picks the status to answer a request that could not
+// be parsed or framed with. Malformed requests get a 400.
+func parseErrorStatus(err error) int {
+	switch errors.Unwrap(err) {
+	case ErrRequestLineTooLong:
+		return StatusRequestURITooLong
+	case ErrTooManyHeaders, ErrHeaderTooLarge, ErrHeaderBytesTooLarge:
+		return StatusRequestHeaderFieldsTooLarge
+	case ErrBodyTooLarge:
+		return StatusRequestEntityTooLarge
+	case ErrUnsupported:
+		return StatusNotImplemented
+	case ErrUnsupportedVersion:
+		return StatusHTTPVersionNotSupported
+	default:
+		return StatusBadRequest
 	}
-	hc.appendResponse(response)
+}
+
+// appendParseError answers a request that could not be parsed before the
+// connection is closed.
+func (hs *httpServer) appendParseError(hc *httpCodec, err error) {
+	code := parseErrorStatus(err)
+	if hs.errorPage == nil {
+		hc.appendError(code)
+		return
+	}
+
+	hc.discardResponse()
+	hc.status = code
+	hc.close = true
+	hs.errorPage(hc, code, err)
+	hc.finishResponse()
+}
+
+var c100Continue = []byte("100-continue")
+
+// checkExpect answers the Expect header of hp: StatusContinue to go on and
+// read the body, or the final status to refuse the request with.
+func (hs *httpServer) checkExpect(hp *HTTPParser) int {
+	if !bytes.EqualFold(hp.HeaderValue(HeaderExpect), c100Continue) {
+		return StatusExpectationFailed
+	}
+
+	if hs.expect != nil {
+		return hs.expect(hp)
+	}
+
+	return StatusContinue
 }
 
 func (hs *httpServer) OnTraffic(c gnet.Conn) gnet.Action {
@@ -104,35 +529,133 @@ func (hs *httpServer) OnTraffic(c gnet.Conn) gnet.Action {
 	}
 	hc := ctx.httpCodec
 
-	// check http packet is completed
-	peeked, _ := c.Peek(c.InboundBuffered())
-	if !bytes.Contains(peeked, []byte("\r\n\r\n")) {
-		// data not enough do it next round
-		return gnet.None
+	// Both the parser and the framing resume where the previous event
+	// stopped, so a request arriving in many small segments is only
+	// scanned once and dispatched when its body is complete. Pipelined
+	// requests are answered in order and a trailing partial request is
+	// left in the inbound buffer. gnettls does not support Peek(-1).
+	data, _ := c.Peek(c.InboundBuffered())
+
+	max := hs.maxPipelined
+	if max <= 0 {
+		max = DefaultMaxPipelined
 	}
 
+	draining := hs.drain.Draining()
+
 	hc.buf.Reset()
-	data, _ := c.Next(-1)
-	for {
-		headerOffset, err := hc.parser.Parse(data)
+	consumed := 0
+	served := 0
+	for len(data) > 0 {
+		if served == max {
+			// come back for the rest once the other connections had a turn
+			_ = c.Wake(nil)
+			break
+		}
+
+		n, err := hc.frame(data)
+		if hc.expect {
+			hc.expect = false
+			if code := hs.checkExpect(hc.parser); code != StatusContinue {
+				// the client may be sending the body anyway, so don't
+				// try to find the next request after it
+				hc.appendError(code)
+				c.Write(hc.buf.B)
+				return gnet.Close
+			}
+			if err == ErrMissingData {
+				// queued after the responses to earlier pipelined requests
+				hc.buf.Write(continueResponse)
+			}
+		}
+		if err == ErrMissingData {
+			// data not enough do it next round
+			break
+		}
 		if err != nil {
-			c.Write(errMsgBytes)
+			// after the responses to the requests before it
+			hs.appendParseError(hc, err)
+			c.Write(hc.buf.B)
 			return gnet.Close
 		}
-		route(hc)
-		bodyLen := int(hc.parser.ContentLength())
-		if bodyLen == -1 {
-			bodyLen = 0
+		if draining && n == len(data) {
+			// the last request the client sent before we started
+			// draining, tell it to go elsewhere
+			hc.close = true
 		}
-		data = data[headerOffset+bodyLen:]
-		if len(data) == 0 {
-			break //this is pipelined requests, do not use this feature
+		if hs.handler != nil {
+			hc.serveHTTP(hs.handler, c)
+		} else {
+			hs.router.Serve(hc)
+		}
+		hc.finishResponse()
+		keepAlive := hc.parser.KeepAlive() && !hc.close
+		hc.close = false
+		hc.sent = 0
+		// the parser is shared by every request on this connection
+		hc.parser.Reset()
+		if !keepAlive {
+			c.Write(hc.buf.B)
+			return gnet.Close
 		}
+		data = data[n:]
+		consumed += n
+		served++
+	}
+	hc.stale = hc.headerLen > 0
+	hc.pending = len(data) > 0
+
+	// a timeout runs from the start of its phase, so trickling bytes in
+	// does not extend it
+	phase := phaseIdle
+	switch {
+	case hc.headerLen > 0:
+		phase = phaseBody
+	case len(data) > 0:
+		phase = phaseHeader
+	}
+	if phase != hc.phase || served > 0 {
+		hs.enterPhase(hc, phase)
+	}
+
+	if consumed > 0 {
+		_, _ = c.Discard(consumed)
+	}
+	if hc.buf.Len() > 0 {
+		c.Write(hc.buf.B)
+	}
+	if draining && !hc.pending {
+		return gnet.Close
 	}
-	c.Write(hc.buf.B)
 	return gnet.None
 }
 
+// Shutdown drains the server: new connections are refused, idle ones are
+// closed and the others are closed after answering the requests they
+// already sent, the last response carrying "Connection: close". The
+// engine is stopped once they are all gone or ctx is done.
+func (hs *httpServer) Shutdown(ctx context.Context) error {
+	hs.drain.Begin()
+	hs.conns.Range(func(k, v interface{}) bool {
+		c, hc := k.(gnet.Conn), v.(*httpCodec)
+		// runs on the event loop of c, after OnTraffic if anything was
+		// buffered
+		_ = c.Wake(func(gnet.Conn, error) error {
+			if !hc.pending {
+				return c.Close()
+			}
+			return nil
+		})
+		return true
+	})
+
+	err := hs.drain.Drain(ctx)
+	if stopErr := hs.eng.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
 func mustLoadCertificate() tls.Certificate {
 	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
 	if err != nil {
@@ -142,19 +665,45 @@ func mustLoadCertificate() tls.Certificate {
 }
 
 func main() {
-	go func() {
-		hs := &httpServer{
-			addr:      fmt.Sprintf("tcp://:%d", 8080),
-			multicore: true,
-		}
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
+	flag.Parse()
 
-		options := []gnet.Option{
-			gnet.WithMulticore(true),
-			gnet.WithTCPKeepAlive(time.Minute * 5),
-			gnet.WithReusePort(true),
-		}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Hello from %s\n", r.Host)
+	})
+
+	servers := []*httpServer{{
+		addr:      fmt.Sprintf("tcp://:%d", 8080),
+		multicore: true,
+		timeouts:  DefaultTimeouts,
+		router:    newRouter(),
+	}, {
+		addr:      fmt.Sprintf("tcp://:%d", 8443),
+		multicore: true,
+		timeouts:  DefaultTimeouts,
+		router:    newRouter(),
+	}, {
+		addr:      fmt.Sprintf("tcp://:%d", 8081),
+		multicore: true,
+		timeouts:  DefaultTimeouts,
+		handler:   mux,
+	}}
 
-		log.Fatal(gnet.Run(hs, hs.addr, options...))
+	options := []gnet.Option{
+		gnet.WithMulticore(true),
+		gnet.WithTCPKeepAlive(time.Minute * 5),
+		gnet.WithReusePort(true),
+		gnet.WithTicker(true),
+	}
+
+	go func() {
+		hs := servers[0]
+		if err := gnet.Run(hs, hs.addr, options...); err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	go func() {
@@ -162,19 +711,31 @@ func main() {
 			Certificates: []tls.Certificate{mustLoadCertificate()},
 		}
 
-		hs := &httpServer{
-			addr:      fmt.Sprintf("tcp://:%d", 8443),
-			multicore: true,
+		hs := servers[1]
+		if err := gnettls.Run(hs, hs.addr, tlsConfig, options...); err != nil {
+			log.Fatal(err)
 		}
+	}()
 
-		options := []gnet.Option{
-			gnet.WithMulticore(true),
-			gnet.WithTCPKeepAlive(time.Minute * 5),
-			gnet.WithReusePort(true),
+	go func() {
+		hs := servers[2]
+		if err := gnet.Run(hs, hs.addr, options...); err != nil {
+			log.Fatal(err)
 		}
-
-		log.Fatal(gnettls.Run(hs, hs.addr, tlsConfig, options...))
 	}()
 
-	select {}
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, hs := range servers {
+		wg.Add(1)
+		go func(hs *httpServer) {
+			defer wg.Done()
+			if err := hs.Shutdown(ctx); err != nil {
+				log.Printf("HTTP server on %s: %v", hs.addr, err)
+			}
+		}(hs)
+	}
+	wg.Wait()
 }
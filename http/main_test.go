@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/valyala/bytebufferpool"
+
+	"gnet-example/timewheel"
+)
+
+// fakeConn feeds OnTraffic from memory. Methods the server does not use
+// fall through to the nil embedded interface and panic.
+type fakeConn struct {
+	gnet.Conn
+	in     []byte
+	out    bytes.Buffer
+	ctx    interface{}
+	woken  bool
+	wake   gnet.AsyncCallback
+	closed bool
+}
+
+func (fc *fakeConn) Peek(n int) ([]byte, error) {
+	// like gnettls, which slices [:n] and so panics on n < 0
+	if n < 0 || n > len(fc.in) {
+		return nil, io.ErrShortBuffer
+	}
+	// a copy, as gnet may hand out different memory on every event
+	return append([]byte(nil), fc.in[:n]...), nil
+}
+
+func (fc *fakeConn) Discard(n int) (int, error) {
+	fc.in = fc.in[n:]
+	return n, nil
+}
+
+func (fc *fakeConn) Write(b []byte) (int, error) { return fc.out.Write(b) }
+func (fc *fakeConn) InboundBuffered() int        { return len(fc.in) }
+func (fc *fakeConn) Context() interface{}        { return fc.ctx }
+func (fc *fakeConn) SetContext(ctx interface{})  { fc.ctx = ctx }
+func (fc *fakeConn) RemoteAddr() net.Addr        { return nil }
+
+func (fc *fakeConn) Close() error {
+	fc.closed = true
+	return nil
+}
+
+func (fc *fakeConn) Wake(cb gnet.AsyncCallback) error {
+	fc.woken = true
+	fc.wake = cb
+	return nil
+}
+
+func newFakeConn(hs *httpServer) *fakeConn {
+	fc := &fakeConn{}
+	hs.OnOpen(fc)
+	return fc
+}
+
+// send delivers data as one event and returns what the server wrote.
+func (fc *fakeConn) send(hs *httpServer, data string) (string, gnet.Action) {
+	fc.in = append(fc.in, data...)
+	fc.out.Reset()
+	action := hs.OnTraffic(fc)
+	return fc.out.String(), action
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	r := NewRouter()
+	r.Handle("POST", "/hello", func(hc *httpCodec) { hc.appendResponse(nil) })
+	hs := &httpServer{router: r}
+	fc := newFakeConn(hs)
+
+	out, _ := fc.send(hs, "POST /hello HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	if out != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("Expected 100 Continue, got %q", out)
+	}
+
+	out, _ = fc.send(hs, "hello")
+	if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("Expected final response after the body, got %q", out)
+	}
+
+	hs.expect = func(hp *HTTPParser) int { return StatusRequestEntityTooLarge }
+	fc = newFakeConn(hs)
+	out, action := fc.send(hs, "POST /hello HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n") || action != gnet.Close {
+		t.Errorf("Expected rejection with 413, got %q", out)
+	}
+
+	fc = newFakeConn(hs)
+	out, _ = fc.send(hs, "POST /hello HTTP/1.1\r\nContent-Length: 5\r\nExpect: something\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n") {
+		t.Errorf("Expected 417, got %q", out)
+	}
+}
+
+func TestServerNetHTTP(t *testing.T) {
+	hs := &httpServer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Id", "1\r\nInjected: yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "got %s", body)
+	})}
+	fc := newFakeConn(hs)
+
+	out, action := fc.send(hs, "POST /a HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi")
+	if !strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n") || !strings.HasSuffix(out, "\r\n\r\ngot hi") {
+		t.Fatalf("Expected 201 with body, got %q", out)
+	}
+	for _, want := range []string{"Content-Length: 6\r\n", "Content-Type: text/plain; charset=utf-8\r\n", "X-Id: 1  Injected: yes\r\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in %q", want, out)
+		}
+	}
+	if action != gnet.None {
+		t.Errorf("Expected connection kept open, got %v", action)
+	}
+
+	out, _ = fc.send(hs, "HEAD /a HTTP/1.1\r\n\r\n")
+	if !strings.Contains(out, "Content-Length: 4\r\n") || !strings.HasSuffix(out, "\r\n\r\n") {
+		t.Errorf("Expected HEAD response without body, got %q", out)
+	}
+
+	hs.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+	})
+	out, action = fc.send(hs, "GET /a HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || action != gnet.Close {
+		t.Errorf("Expected handler to close the connection, got %q", out)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	for _, pattern := range []string{"/users", "/users/:id", "/users/:id/posts", "/users/new", "/static/*file"} {
+		pattern := pattern
+		r.Handle("GET", pattern, func(hc *httpCodec) {
+			hc.appendResponse([]byte(pattern + " " + string(hc.parser.Param([]byte("id"))) + string(hc.parser.Param([]byte("file")))))
+		})
+	}
+	r.Handle("DELETE", "/users/:id", func(hc *httpCodec) { hc.appendResponse(nil) })
+	hs := &httpServer{router: r}
+	fc := newFakeConn(hs)
+
+	for path, want := range map[string]string{
+		"/users":         "/users ",
+		"/users/7":       "/users/:id 7",
+		"/users/new":     "/users/new ",
+		"/users/ne":      "/users/:id ne",
+		"/users/7/posts": "/users/:id/posts 7",
+		"/static/a/b.js": "/static/*file a/b.js",
+		// matched encoded, captured values decoded
+		"/users/a%2Fb":       "/users/:id a/b",
+		"/users/a%2Fb/posts": "/users/:id/posts a/b",
+		"/static/a%20b.js":   "/static/*file a b.js",
+	} {
+		out, _ := fc.send(hs, "GET "+path+" HTTP/1.1\r\n\r\n")
+		if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(out, "\r\n\r\n"+want) {
+			t.Errorf("%s: expected %q, got %q", path, want, out)
+		}
+	}
+
+	for _, path := range []string{"/users/7/comments", "/users%2F7"} {
+		out, _ := fc.send(hs, "GET "+path+" HTTP/1.1\r\n\r\n")
+		if !strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n") {
+			t.Errorf("%s: expected 404, got %q", path, out)
+		}
+	}
+
+	out, _ := fc.send(hs, "POST /users/7 HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n") || !strings.Contains(out, "\r\nAllow: GET, DELETE, HEAD\r\n") {
+		t.Errorf("Expected 405 with Allow, got %q", out)
+	}
+
+	// HEAD is served by the GET route, without the body
+	out, _ = fc.send(hs, "HEAD /users/7 HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(out, "Content-Length: 12\r\n\r\n") {
+		t.Errorf("Expected the GET response header for HEAD, got %q", out)
+	}
+
+	hp := NewHTTPParser()
+	hc := &httpCodec{parser: hp, buf: &bytebufferpool.ByteBuffer{}}
+	req := []byte("GET /users/7%2F8/posts HTTP/1.1\r\n\r\n")
+	r = NewRouter()
+	r.Handle("GET", "/users/:id/posts", func(hc *httpCodec) {})
+	allocs := testing.AllocsPerRun(100, func() {
+		hp.Parse(req)
+		r.Serve(hc)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestRouterConflicts(t *testing.T) {
+	for _, patterns := range [][]string{
+		{"/a", "/a"},
+		{"/users/:id", "/users/:name"},
+		{"/static/*file/x"},
+		{"no-slash"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected %v to panic", patterns)
+				}
+			}()
+			r := NewRouter()
+			for _, p := range patterns {
+				r.Handle("GET", p, func(hc *httpCodec) {})
+			}
+		}()
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var trace []string
+	logged := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(hc *httpCodec) {
+				trace = append(trace, name+">")
+				next.Serve(hc)
+				trace = append(trace, fmt.Sprintf("<%s %d", name, hc.statusCode()))
+			})
+		}
+	}
+	auth := Before(func(hc *httpCodec) bool {
+		if hc.parser.HeaderValue(HeaderAuthorization) == nil {
+			hc.appendStatus(StatusUnauthorized)
+			return false
+		}
+		return true
+	})
+
+	r := NewRouter()
+	r.Use(logged("outer"), logged("inner"))
+	r.Handle("GET", "/public", func(hc *httpCodec) {
+		trace = append(trace, "public")
+		hc.appendResponse([]byte("ok"))
+	})
+	r.Handle("POST", "/private", func(hc *httpCodec) {
+		trace = append(trace, "private")
+		hc.setStatus(StatusCreated)
+	}, auth, logged("route"))
+	hs := &httpServer{router: r}
+	fc := newFakeConn(hs)
+
+	for _, tt := range []struct {
+		req, status, trace string
+	}{
+		{"GET /public HTTP/1.1\r\n\r\n", "200 OK", "outer> inner> public <inner 200 <outer 200"},
+		{"POST /private HTTP/1.1\r\nContent-Length: 0\r\n\r\n", "401 Unauthorized", "outer> inner> <inner 401 <outer 401"},
+		{"POST /private HTTP/1.1\r\nAuthorization: x\r\nContent-Length: 0\r\n\r\n", "201 Created", "outer> inner> route> private <route 201 <inner 201 <outer 201"},
+		{"GET /nowhere HTTP/1.1\r\n\r\n", "404 Not Found", "outer> inner> <inner 404 <outer 404"},
+	} {
+		trace = trace[:0]
+		out, _ := fc.send(hs, tt.req)
+		if !strings.HasPrefix(out, "HTTP/1.1 "+tt.status+"\r\n") {
+			t.Errorf("Expected %s to %.30q, got %q", tt.status, tt.req, out)
+		}
+		if got := strings.Join(trace, " "); got != tt.trace {
+			t.Errorf("Expected trace %q, got %q", tt.trace, got)
+		}
+	}
+
+	var status int
+	hs = &httpServer{router: Chain(newRouter(), After(func(hc *httpCodec) { status = hc.statusCode() }))}
+	fc = newFakeConn(hs)
+	out, _ := fc.send(hs, "GET /time HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || status != StatusOK {
+		t.Errorf("Expected a chained router to serve with status 200, got %d and %q", status, out)
+	}
+}
+
+func TestServerResponseBuilder(t *testing.T) {
+	r := NewRouter()
+	r.Handle("POST", "/items", func(hc *httpCodec) {
+		hc.setStatus(StatusCreated)
+		hc.setContentType("application/json")
+		hc.addHeader("Location", "/items/1")
+		fmt.Fprintf(hc, `{"id":%d}`, 1)
+	})
+	r.Handle("GET", "/empty", func(hc *httpCodec) {
+		hc.setStatus(StatusNoContent)
+	})
+	r.Handle("GET", "/quiet", func(hc *httpCodec) {})
+	r.Handle("GET", "/fail", func(hc *httpCodec) {
+		hc.WriteString("partial")
+		hc.appendStatus(StatusInternalServerError)
+	})
+	hs := &httpServer{router: r}
+	fc := newFakeConn(hs)
+
+	out, _ := fc.send(hs, "POST /items HTTP/1.1\r\nContent-Length: 0\r\n\r\nGET /empty HTTP/1.1\r\n\r\n")
+	first, second, _ := strings.Cut(out, `{"id":1}`)
+	if !strings.HasPrefix(first, "HTTP/1.1 201 Created\r\n") || !strings.HasSuffix(first, "\r\n\r\n") {
+		t.Fatalf("Expected 201 before its body, got %q", out)
+	}
+	for _, want := range []string{"Content-Type: application/json\r\n", "Content-Length: 8\r\n", "Location: /items/1\r\n"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("Expected %q in %q", want, first)
+		}
+	}
+	if !strings.HasPrefix(second, "HTTP/1.1 204 No Content\r\n") || strings.Contains(second, "Content-Length") {
+		t.Errorf("Expected 204 without Content-Length, got %q", second)
+	}
+
+	out, _ = fc.send(hs, "GET /quiet HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") || !strings.Contains(out, "Content-Length: 0\r\n") {
+		t.Errorf("Expected empty 200, got %q", out)
+	}
+
+	// the status replaces what was written, the next response follows it
+	out, _ = fc.send(hs, "GET /fail HTTP/1.1\r\n\r\nGET /quiet HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n") || strings.Contains(out, "partial") {
+		t.Errorf("Expected 500 without the partial body, got %q", out)
+	}
+	if !strings.Contains(out, "\r\n\r\nInternal Server ErrorHTTP/1.1 200 OK\r\n") {
+		t.Errorf("Expected 200 after the 500, got %q", out)
+	}
+
+	out, _ = fc.send(hs, "HEAD /nowhere HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n") || !strings.HasSuffix(out, "Content-Length: 9\r\n\r\n") {
+		t.Errorf("Expected 404 header only, got %q", out)
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/:n", func(hc *httpCodec) { hc.Write(hc.parser.PathParam([]byte("n"))) })
+	hs := &httpServer{router: r, maxPipelined: 2}
+	fc := newFakeConn(hs)
+
+	out, _ := fc.send(hs, "GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\nGET /3 HTTP/1.1\r\n\r\nGET /4 HT")
+	if strings.Count(out, "HTTP/1.1 200 OK") != 2 || !strings.HasSuffix(out, "\r\n\r\n2") || !fc.woken {
+		t.Fatalf("Expected two responses and a wake-up, got %q", out)
+	}
+
+	fc.woken = false
+	out, _ = fc.send(hs, "")
+	if strings.Count(out, "HTTP/1.1 200 OK") != 1 || !strings.HasSuffix(out, "\r\n\r\n3") || fc.woken {
+		t.Fatalf("Expected the third response, got %q", out)
+	}
+	if string(fc.in) != "GET /4 HT" {
+		t.Errorf("Expected the partial request to stay buffered, got %q", fc.in)
+	}
+
+	out, _ = fc.send(hs, "TP/1.1\r\n\r\nGET /5 HTTP/1.1\r\nHost: a\r\n\r\n\x01 / HTTP/1.1\r\n\r\n")
+	first, rest, _ := strings.Cut(out, "\r\n\r\n4")
+	if !strings.HasPrefix(first, "HTTP/1.1 200 OK") || !strings.HasPrefix(rest, "HTTP/1.1 200 OK") || !strings.Contains(rest, "\r\n\r\n5") {
+		t.Errorf("Expected responses 4 and 5 before the error, got %q", out)
+	}
+}
+
+func TestServerParseErrors(t *testing.T) {
+	long := "GET /" + strings.Repeat("a", DefaultParserLimits.MaxRequestLineSize) + " HTTP/1.1\r\n\r\n"
+	tests := []struct {
+		req  string
+		code int
+	}{
+		{"GET / HTTP/1.1\r\nHost a\r\n\r\n", StatusBadRequest},
+		{"GET / HTTP/1.1\nHost: a\n\n", StatusBadRequest},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", StatusBadRequest},
+		{long, StatusRequestURITooLong},
+		{"GET / HTTP/1.1\r\nX: " + strings.Repeat("a", DefaultParserLimits.MaxHeaderSize) + "\r\n\r\n", StatusRequestHeaderFieldsTooLarge},
+		{"POST / HTTP/1.1\r\nContent-Length: 99999999\r\n\r\n", StatusRequestEntityTooLarge},
+		// an overflowing length must not pass for no body, or the body
+		// would be answered as the next request
+		{"POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\nGET /hello HTTP/1.1\r\n\r\n", StatusBadRequest},
+		{"POST / HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello", StatusBadRequest},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", StatusNotImplemented},
+		{"GET / HTTP/2.0\r\n\r\n", StatusHTTPVersionNotSupported},
+	}
+
+	for _, tt := range tests {
+		hs := &httpServer{router: newRouter()}
+		fc := newFakeConn(hs)
+		out, action := fc.send(hs, tt.req)
+		status := string(AppendStatusLine(nil, tt.code))
+		if !strings.HasPrefix(out, status) || !strings.Contains(out, "\r\nConnection: close\r\n") || !strings.HasSuffix(out, "\r\n\r\n") {
+			t.Errorf("Expected a framed %d response to %.40q, got %q", tt.code, tt.req, out)
+		}
+		if action != gnet.Close {
+			t.Errorf("Expected the connection to close after %.40q", tt.req)
+		}
+	}
+
+	var got error
+	hs := &httpServer{
+		router: newRouter(),
+		errorPage: func(hc *httpCodec, code int, err error) {
+			got = err
+			hc.setContentType("text/html")
+			hc.WriteString("<h1>" + StatusText(code) + "</h1>")
+		},
+	}
+	fc := newFakeConn(hs)
+	out, _ := fc.send(hs, "GET / HTTP/2.0\r\n\r\n")
+	want := "<h1>" + StatusText(StatusHTTPVersionNotSupported) + "</h1>"
+	if !strings.HasPrefix(out, "HTTP/1.1 505 ") || !strings.Contains(out, "Content-Type: text/html\r\n") ||
+		!strings.Contains(out, "\r\nConnection: close\r\n") || !strings.HasSuffix(out, "\r\n\r\n"+want) {
+		t.Errorf("Expected the custom error page, got %q", out)
+	}
+	if got != ErrUnsupportedVersion {
+		t.Errorf("Expected the parser error to reach the hook, got %v", got)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	hs := &httpServer{
+		router:   newRouter(),
+		timeouts: Timeouts{Header: 2 * time.Second, Body: 3 * time.Second, Idle: time.Second},
+		wheel:    timewheel.New(time.Second, 8),
+	}
+	advance := func(n int) {
+		for i := 0; i < n; i++ {
+			hs.wheel.Advance()
+		}
+	}
+
+	// trickling the header in does not extend the header timeout
+	slow := newFakeConn(hs)
+	slow.send(hs, "GET /hello HT")
+	advance(1)
+	slow.send(hs, "TP/1.1\r\n")
+	if slow.closed {
+		t.Fatalf("Expected connection open before the header timeout")
+	}
+	advance(1)
+	if !slow.closed {
+		t.Errorf("Expected header timeout to close the connection")
+	}
+
+	idle := newFakeConn(hs)
+	advance(1)
+	idle.send(hs, "GET /hello HTTP/1.1\r\n\r\n")
+	advance(1)
+	if !idle.closed {
+		t.Errorf("Expected idle timeout to close the connection")
+	}
+
+	upload := newFakeConn(hs)
+	upload.send(hs, "POST /hello HTTP/1.1\r\nContent-Length: 5\r\n\r\nab")
+	advance(2)
+	upload.send(hs, "c")
+	if upload.closed {
+		t.Fatalf("Expected connection open before the body timeout")
+	}
+	advance(1)
+	if !upload.closed {
+		t.Errorf("Expected body timeout to close the connection")
+	}
+
+	hs.OnClose(upload, nil)
+	done := newFakeConn(hs)
+	hs.OnClose(done, nil)
+	advance(8)
+	if done.closed {
+		t.Errorf("Expected no timeout after OnClose")
+	}
+}
+
+func TestServerCloseTLS(t *testing.T) {
+	hs := &httpServer{router: newRouter()}
+	fc := newFakeConn(hs)
+
+	// gnettls closes the raw connection, the TLS one is its context
+	hs.OnClose(&fakeConn{ctx: fc}, nil)
+	if _, ok := hs.conns.Load(fc); ok {
+		t.Errorf("Expected the connection to be released")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	hs := &httpServer{router: newRouter()}
+	idle := newFakeConn(hs)
+	idle.send(hs, "GET /hello HTTP/1.1\r\n\r\n")
+	busy := newFakeConn(hs)
+	busy.send(hs, "GET /hello HTTP/1.1\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the fake connections only close when told, and there is no engine
+	if err := hs.Shutdown(ctx); err == nil {
+		t.Errorf("Expected Shutdown to give up on open connections")
+	}
+
+	if _, action := hs.OnOpen(&fakeConn{}); action != gnet.Close {
+		t.Errorf("Expected new connections to be refused while draining")
+	}
+
+	idle.wake(idle, nil)
+	busy.wake(busy, nil)
+	if !idle.closed || busy.closed {
+		t.Errorf("Expected only the idle connection closed, got idle %t, busy %t", idle.closed, busy.closed)
+	}
+
+	out, action := busy.send(hs, "Host: a\r\n\r\n")
+	if !strings.Contains(out, "\r\nConnection: close\r\n") || action != gnet.Close {
+		t.Errorf("Expected the last response to close the connection, got %q", out)
+	}
+}
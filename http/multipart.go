@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/vektra/errors"
+)
+
+var (
+	ErrNotMultipart = errors.New("not a multipart/form-data request")
+	ErrTooManyParts = errors.New("too many multipart parts")
+	ErrPartTooLarge = errors.New("multipart part too large")
+)
+
+// MultipartLimits bounds what a MultipartReader accepts. A zero field
+// disables that limit.
+type MultipartLimits struct {
+	MaxParts           int
+	MaxPartSize        int64 // body of a single part
+	MaxPartHeaderBytes int   // header block of a single part
+}
+
+var DefaultMultipartLimits = MultipartLimits{
+	MaxParts:           1000,
+	MaxPartSize:        32 << 20,
+	MaxPartHeaderBytes: 8 << 10,
+}
+
+// multipartBufferSize is the read buffer of a MultipartReader, it must
+// hold a delimiter and a part header line.
+const multipartBufferSize = 8 << 10
+
+// MultipartReader streams the parts of a multipart/form-data body. Only a
+// buffer's worth of the body is held at any time, so file uploads can be
+// copied out part by part.
+type MultipartReader struct {
+	Limits MultipartLimits
+
+	r      *bufio.Reader
+	dash   []byte // "--boundary"
+	nlDash []byte // "\r\n--boundary"
+
+	part   Part
+	header []byte
+	parts  int
+	done   bool
+}
+
+// Part is one part of a multipart body. Its headers are looked up with
+// FindHeader and HeaderValue; they, FormName and FileName are only valid
+// until the next call to NextPart.
+type Part struct {
+	header headerParser
+
+	mr   *MultipartReader
+	size int64
+	err  error
+
+	name, filename []byte
+}
+
+var (
+	cMultipartFormData = []byte("multipart/form-data")
+	cBoundary          = []byte("boundary")
+	cName              = []byte("name")
+	cFilename          = []byte("filename")
+)
+
+// Return a MultipartReader over body, which is normally what BodyReader
+// returned, taking the boundary from the Content-Type header.
+func (hp *HTTPParser) MultipartReader(body io.Reader) (*MultipartReader, error) {
+	ct := hp.HeaderValue(HeaderContentType)
+
+	mediaType := ct
+	if i := bytes.IndexByte(ct, ';'); i != -1 {
+		mediaType = ct[:i]
+	}
+
+	if !bytes.EqualFold(bytes.Trim(mediaType, " \t"), cMultipartFormData) {
+		return nil, ErrNotMultipart
+	}
+
+	boundary := headerParam(ct, cBoundary)
+	if len(boundary) == 0 || len(boundary) > 70 {
+		return nil, errors.Context(ErrNotMultipart, "invalid boundary")
+	}
+
+	return NewMultipartReader(body, boundary), nil
+}
+
+// Create a MultipartReader for a body delimited by boundary.
+func NewMultipartReader(body io.Reader, boundary []byte) *MultipartReader {
+	nlDash := make([]byte, 0, len(boundary)+4)
+	nlDash = append(nlDash, "\r\n--"...)
+	nlDash = append(nlDash, boundary...)
+
+	mr := &MultipartReader{
+		Limits: DefaultMultipartLimits,
+		r:      bufio.NewReaderSize(body, multipartBufferSize),
+		dash:   nlDash[2:],
+		nlDash: nlDash,
+	}
+	mr.part.mr = mr
+	mr.part.header = newHeaderParser(DefaultHeaderSlice, eNextHeader)
+	return mr
+}
+
+// NextPart skips what is left of the current part and returns the next
+// one, or io.EOF after the last. The returned Part is reused by the next
+// call.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	if mr.parts > 0 {
+		if err := mr.part.Close(); err != nil {
+			return nil, err
+		}
+
+		// the delimiter ends the part body, what follows it on the line
+		// says whether this was the last part
+		if _, err := mr.r.Discard(len(mr.nlDash)); err != nil {
+			return nil, err
+		}
+
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.HasPrefix(line, []byte("--")) {
+			mr.done = true
+			return nil, io.EOF
+		}
+	} else if err := mr.skipPreamble(); err != nil {
+		return nil, err
+	}
+
+	if max := mr.Limits.MaxParts; max > 0 && mr.parts >= max {
+		return nil, ErrTooManyParts
+	}
+	mr.parts++
+
+	if err := mr.readPartHeader(); err != nil {
+		return nil, err
+	}
+
+	return &mr.part, nil
+}
+
+// skipPreamble moves past everything up to the first delimiter line.
+func (mr *MultipartReader) skipPreamble() error {
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return err
+		}
+
+		if !bytes.HasPrefix(line, mr.dash) {
+			continue
+		}
+
+		switch rest := line[len(mr.dash):]; {
+		case len(rest) == 0:
+			return nil
+		case bytes.Equal(rest, []byte("--")):
+			mr.done = true
+			return io.EOF
+		}
+	}
+}
+
+// readLine returns the next line without its line ending or trailing
+// whitespace.
+func (mr *MultipartReader) readLine() ([]byte, error) {
+	line, err := mr.r.ReadSlice('\n')
+	switch err {
+	case nil:
+	case bufio.ErrBufferFull:
+		return nil, errors.Context(ErrBadProto, "multipart line too long")
+	case io.EOF:
+		return nil, io.ErrUnexpectedEOF
+	default:
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, " \t\r\n"), nil
+}
+
+func (mr *MultipartReader) readPartHeader() error {
+	mr.header = mr.header[:0]
+
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		switch err {
+		case nil:
+		case bufio.ErrBufferFull:
+			return ErrHeaderTooLarge
+		case io.EOF:
+			return io.ErrUnexpectedEOF
+		default:
+			return err
+		}
+
+		mr.header = append(mr.header, line...)
+		if max := mr.Limits.MaxPartHeaderBytes; max > 0 && len(mr.header) > max {
+			return ErrHeaderBytesTooLarge
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	p := &mr.part
+	p.header.reset()
+	p.size = 0
+	p.err = nil
+
+	if _, err := p.header.parse(mr.header); err != nil {
+		return err
+	}
+
+	cd := p.HeaderValue(HeaderContentDisposition)
+	p.name = headerParam(cd, cName)
+	p.filename = headerParam(cd, cFilename)
+	return nil
+}
+
+// Return the value of the part header called name, or nil.
+func (p *Part) FindHeader(name []byte) []byte {
+	return p.header.FindHeader(name)
+}
+
+// Return the value of a well-known part header, or nil.
+func (p *Part) HeaderValue(id HeaderID) []byte {
+	return p.header.HeaderValue(id)
+}
+
+// Return the form field name from Content-Disposition.
+func (p *Part) FormName() []byte {
+	return p.name
+}
+
+// Return the file name from Content-Disposition, nil when the part is a
+// plain field rather than a file.
+func (p *Part) FileName() []byte {
+	return p.filename
+}
+
+// Read reads the part body, stopping at the delimiter of the next part.
+func (p *Part) Read(d []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	if len(d) == 0 {
+		return 0, nil
+	}
+
+	mr := p.mr
+	for {
+		peek, _ := mr.r.Peek(mr.r.Buffered())
+
+		i := bytes.Index(peek, mr.nlDash)
+		if i == 0 {
+			p.err = io.EOF
+			return 0, p.err
+		}
+
+		// without a delimiter in view, hold back a tail that could be
+		// the start of one
+		avail := i
+		if i == -1 {
+			avail = len(peek) - len(mr.nlDash) + 1
+		}
+
+		if avail > 0 {
+			if avail > len(d) {
+				avail = len(d)
+			}
+
+			n, _ := mr.r.Read(d[:avail])
+			p.size += int64(n)
+			if max := mr.Limits.MaxPartSize; max > 0 && p.size > max {
+				p.err = ErrPartTooLarge
+				return 0, p.err
+			}
+
+			return n, nil
+		}
+
+		if _, err := mr.r.Peek(len(peek) + 1); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			p.err = err
+			return 0, err
+		}
+	}
+}
+
+// Close skips the rest of the part body.
+func (p *Part) Close() error {
+	if p.err == nil {
+		if err := drain(p); err != nil {
+			return err
+		}
+	}
+
+	if p.err != io.EOF {
+		return p.err
+	}
+
+	return nil
+}
+
+// headerParam returns the value of the parameter called name in a header
+// value like `form-data; name="field"`, without its quotes, or nil.
+func headerParam(value, name []byte) []byte {
+	i := bytes.IndexByte(value, ';')
+	if i == -1 {
+		return nil
+	}
+	rest := value[i+1:]
+
+	for len(rest) > 0 {
+		var param []byte
+		param, rest = nextParam(rest)
+
+		eq := bytes.IndexByte(param, '=')
+		if eq == -1 {
+			continue
+		}
+
+		if !bytes.EqualFold(bytes.Trim(param[:eq], " \t"), name) {
+			continue
+		}
+
+		v := bytes.Trim(param[eq+1:], " \t")
+		if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		return v
+	}
+
+	return nil
+}
+
+// nextParam splits off the first ';' separated parameter, leaving quoted
+// strings intact.
+func nextParam(s []byte) (param, rest []byte) {
+	quoted := false
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted:
+			// flip ahead of an escaped quote, so reaching it leaves the
+			// string open
+			if i+1 < len(s) && s[i+1] == '"' {
+				quoted = !quoted
+			}
+		case c == ';' && !quoted:
+			return s[:i], s[i+1:]
+		}
+	}
+
+	return s, nil
+}
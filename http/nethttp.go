@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+
+	cxstrconv "github.com/cloudxaas/gostrconv"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/vektra/errors"
+
+	"gnet-example/httpdate"
+)
+
+// NewRequest builds a net/http request from the parsed header so existing
+// http.Handler implementations can serve it. body is the reader returned by
+// BodyReader and may be nil. Unlike the rest of the parser this copies
+// everything, since net/http keeps strings and a header map.
+func (hp *HTTPParser) NewRequest(body io.ReadCloser) (*http.Request, error) {
+	target := string(hp.Path)
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, errors.Context(ErrBadProto, "request target")
+	}
+
+	header := make(http.Header, hp.NumHeaders)
+	for _, h := range hp.Headers[:hp.NumHeaders] {
+		key := textproto.CanonicalMIMEHeaderKey(string(h.Name))
+		header[key] = append(header[key], string(h.Value))
+	}
+
+	r := &http.Request{
+		Method:     string(hp.Method),
+		URL:        u,
+		Proto:      string(hp.Version),
+		ProtoMajor: hp.ProtoMajor,
+		ProtoMinor: hp.ProtoMinor,
+		Header:     header,
+		Body:       body,
+		Host:       u.Host,
+		Close:      !hp.KeepAlive(),
+		RequestURI: target,
+	}
+	// as in net/http, an absolute-form target wins over the Host header
+	// and the header itself is only kept in r.Host
+	if r.Host == "" {
+		r.Host = string(hp.Host())
+	}
+	delete(header, "Host")
+
+	if hp.Chunked() {
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+	} else if cl := hp.ContentLength(); cl > 0 {
+		r.ContentLength = cl
+	}
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	return r, nil
+}
+
+// responseWriter is the http.ResponseWriter handed to net/http handlers.
+// The body is buffered so the response can carry a Content-Length, then
+// serialized into the connection buffer once the handler returns.
+type responseWriter struct {
+	hc     *httpCodec
+	header http.Header
+	status int
+	body   []byte
+	head   bool // HEAD request, the body is counted but not sent
+}
+
+func (w *responseWriter) reset(hc *httpCodec, head bool) {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	for k := range w.header {
+		delete(w.header, k)
+	}
+	w.hc = hc
+	w.status = 0
+	w.body = w.body[:0]
+	w.head = head
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != StatusSwitchingProtocols {
+		// informational responses go out ahead of the final one
+		w.hc.buf.B = AppendStatusLine(w.hc.buf.B, code)
+		w.hc.buf.B = appendHeaderMap(w.hc.buf.B, w.header)
+		w.hc.buf.WriteString("\r\n")
+		return
+	}
+	w.status = code
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(StatusOK)
+	}
+	if !bodyAllowedForStatus(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
+
+// finish serializes the response into the connection buffer.
+func (w *responseWriter) finish() {
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	hc := w.hc
+	h := w.header
+	hc.buf.B = AppendStatusLine(hc.buf.B, w.status)
+	hc.sent = w.status
+
+	bodyAllowed := bodyAllowedForStatus(w.status)
+	if bodyAllowed {
+		if _, ok := h["Content-Type"]; !ok && len(w.body) > 0 {
+			hc.buf.WriteString("Content-Type: ")
+			hc.buf.WriteString(http.DetectContentType(w.body))
+			hc.buf.WriteString("\r\n")
+		}
+		if _, ok := h["Content-Length"]; !ok {
+			hc.buf.WriteString("Content-Length: ")
+			hc.buf.WriteString(cxstrconv.Inttoa(len(w.body)))
+			hc.buf.WriteString("\r\n")
+		}
+	}
+	if _, ok := h["Date"]; !ok {
+		hc.buf.WriteString("Date: ")
+		hc.buf.Write(httpdate.Load())
+		hc.buf.WriteString("\r\n")
+	}
+
+	switch {
+	case !hc.parser.KeepAlive() || hc.close:
+		h.Del("Connection")
+		hc.buf.WriteString("Connection: close\r\n")
+	case hasToken([]byte(h.Get("Connection")), []byte("close")):
+		hc.close = true
+	case hc.parser.ProtoMinor == 0 && h.Get("Connection") == "":
+		// HTTP/1.0 clients only keep the connection when told so
+		hc.buf.WriteString("Connection: keep-alive\r\n")
+	}
+
+	hc.buf.B = appendHeaderMap(hc.buf.B, h)
+	hc.buf.WriteString("\r\n")
+	if bodyAllowed && !w.head {
+		hc.buf.Write(w.body)
+	}
+	hc.responded = true
+}
+
+// appendHeaderMap writes the lines of h, turning any CR or LF a handler
+// put in a name or value into a space so it cannot split the response.
+func appendHeaderMap(dst []byte, h http.Header) []byte {
+	for k, vv := range h {
+		for _, v := range vv {
+			dst = appendNoNewline(dst, k)
+			dst = append(dst, ": "...)
+			dst = appendNoNewline(dst, v)
+			dst = append(dst, "\r\n"...)
+		}
+	}
+	return dst
+}
+
+func appendNoNewline(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\r' || c == '\n' {
+			c = ' '
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// bodyAllowedForStatus reports whether a response with this status may
+// carry a body.
+func bodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code < 200:
+		return false
+	case code == StatusNoContent, code == StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// serveHTTP runs a net/http handler on the request just framed and
+// appends its response to the connection buffer.
+func (hc *httpCodec) serveHTTP(handler http.Handler, c gnet.Conn) {
+	r, err := hc.parser.NewRequest(hc.bodyReader())
+	if err != nil {
+		hc.appendError(StatusBadRequest)
+		hc.close = true
+		return
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		r.RemoteAddr = addr.String()
+	}
+
+	if hc.writer == nil {
+		hc.writer = &responseWriter{}
+	}
+	w := hc.writer
+	w.reset(hc, r.Method == "HEAD")
+
+	defer func() {
+		// a panic would take down every connection of the event loop
+		if err := recover(); err != nil {
+			log.Printf("http: panic serving %s: %v", r.RemoteAddr, err)
+			hc.appendError(StatusInternalServerError)
+			hc.close = true
+		}
+	}()
+	handler.ServeHTTP(w, r)
+	// drain what the handler left so the next request can be found
+	r.Body.Close()
+	w.finish()
+}
@@ -0,0 +1,115 @@
+package main
+
+import "io"
+
+// HTTPResponseParser parses the status line and headers of an HTTP
+// response with the same zero-copy state machine as HTTPParser, for use
+// by clients and proxies.
+type HTTPResponseParser struct {
+	Version    []byte
+	StatusCode int
+	Reason     []byte
+
+	headerParser
+}
+
+// Create a new response parser
+func NewHTTPResponseParser() *HTTPResponseParser {
+	return NewSizedHTTPResponseParser(DefaultHeaderSlice)
+}
+
+// Create a new response parser allocating size for size headers
+func NewSizedHTTPResponseParser(size int) *HTTPResponseParser {
+	return &HTTPResponseParser{
+		headerParser: newHeaderParser(size, eStatusVersion),
+	}
+}
+
+// Parse the buffer as an HTTP response header. It follows the same rules
+// as HTTPParser.Parse, including resuming after ErrMissingData.
+//
+// Returns the number of bytes used by the header (thus where the body begins).
+func (rp *HTTPResponseParser) Parse(input []byte) (int, error) {
+	if rp.ps.offset > len(input) {
+		rp.ps.reset()
+	}
+
+	if rp.ps.offset == 0 {
+		rp.Reset()
+	}
+
+	n, err := rp.parse(input)
+	if err == nil {
+		rp.Version = rp.ps.tokens[0].of(input)
+		rp.Reason = rp.ps.tokens[2].of(input)
+
+		code := rp.ps.tokens[1].of(input)
+		rp.StatusCode = int(code[0]-'0')*100 + int(code[1]-'0')*10 + int(code[2]-'0')
+
+		n, err = rp.finish(n)
+	}
+
+	if err != ErrMissingData {
+		rp.ps.reset()
+	}
+
+	return n, err
+}
+
+// Reset forgets the previous response so the parser can be reused on the
+// same connection. Parse calls it itself whenever it starts a new response.
+func (rp *HTTPResponseParser) Reset() {
+	rp.Version, rp.Reason = nil, nil
+	rp.StatusCode = 0
+
+	rp.headerParser.reset()
+}
+
+func (rp *HTTPResponseParser) finish(n int) (int, error) {
+	if err := rp.readVersion(rp.Version); err != nil {
+		return 0, err
+	}
+
+	if rp.NoBody() {
+		return n, nil
+	}
+
+	if err := rp.readFraming(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// NoBody reports whether the status code forbids a body (1xx, 204 and
+// 304). A response to a HEAD request has none either, but only the caller
+// knows which request it sent.
+func (rp *HTTPResponseParser) NoBody() bool {
+	return rp.StatusCode < 200 || rp.StatusCode == 204 || rp.StatusCode == 304
+}
+
+// KeepAlive reports whether the connection can be reused for another
+// request once this response has been read. A body delimited by the
+// server closing the connection rules that out whatever the headers say.
+func (rp *HTTPResponseParser) KeepAlive() bool {
+	if !rp.NoBody() && !rp.chunked && rp.ContentLength() < 0 {
+		return false
+	}
+
+	return rp.headerParser.KeepAlive()
+}
+
+// Return a reader for the response body, or nil when there is none.
+// Without Content-Length or chunked coding the body runs until the server
+// closes the connection, as RFC 9112 section 6.3 describes.
+func (rp *HTTPResponseParser) BodyReader(rest []byte, in io.ReadCloser) io.ReadCloser {
+	if rp.NoBody() {
+		return nil
+	}
+
+	if rp.chunked {
+		return newChunkedBodyReader(rp.Limits.MaxBodySize, rp.Strict, rest, in)
+	}
+
+	return BodyReader(rp.ContentLength(), rp.Limits.MaxBodySize, rest, in)
+}
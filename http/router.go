@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/vektra/errors"
+)
+
+var errRouteExists = errors.New("route already registered")
+
+// Router dispatches requests on method and path. Patterns are made of
+// static text, named parameters matching one segment ("/users/:id") and a
+// final wildcard matching the rest of the path ("/static/*file"). Captured
+// values are recorded on the parser, see PathParam and Param.
+//
+// Static text wins over a parameter, which wins over a wildcard. A HEAD
+// request no HEAD route matches is served by the GET route. The path is
+// matched as sent, still percent-encoded, so an encoded '/' stays inside
+// its segment; captured values are decoded. Routing does not allocate.
+//
+// Middleware added with Use wraps every request, unmatched ones included;
+// middleware given to Handle only wraps that route.
+type Router struct {
+	trees []methodTree
+	mw    []Middleware
+	chain Handler // dispatch wrapped in mw, nil without middleware
+
+	// NotFound and MethodNotAllowed answer requests no route matches.
+	// nil sends a bare 404 or 405; the Allow header of a 405 is already
+	// queued when MethodNotAllowed runs.
+	NotFound         HandlerFunc
+	MethodNotAllowed HandlerFunc
+}
+
+type methodTree struct {
+	method []byte
+	root   *node
+}
+
+type node struct {
+	prefix   string  // static text matched by this node
+	indices  []byte  // first byte of each static child
+	children []*node // static children
+	param    *node   // ":name" child, matches one non-empty segment
+	wildcard *node   // "*name" child, matches the rest of the path
+	name     []byte  // parameter name of a param or wildcard node
+	handler  HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers h for method and pattern, wrapped in mw. Like
+// http.ServeMux it panics on an invalid or conflicting pattern, as that is
+// a programming error.
+func (r *Router) Handle(method, pattern string, h HandlerFunc, mw ...Middleware) {
+	if len(pattern) == 0 || pattern[0] != '/' {
+		panic(fmt.Sprintf("router: pattern %q must begin with '/'", pattern))
+	}
+
+	if h == nil {
+		panic("router: nil handler for " + pattern)
+	}
+
+	if len(mw) > 0 {
+		h = Chain(h, mw...).Serve
+	}
+
+	if err := r.tree(method).insert(pattern, h); err != nil {
+		panic(fmt.Sprintf("router: %s %s: %v", method, pattern, err))
+	}
+}
+
+func (r *Router) tree(method string) *node {
+	for _, t := range r.trees {
+		if string(t.method) == method {
+			return t.root
+		}
+	}
+
+	root := &node{}
+	r.trees = append(r.trees, methodTree{[]byte(method), root})
+	return root
+}
+
+func (n *node) insert(rest string, h HandlerFunc) error {
+	if rest == "" {
+		if n.handler != nil {
+			return errRouteExists
+		}
+		n.handler = h
+		return nil
+	}
+
+	switch rest[0] {
+	case ':':
+		end := strings.IndexByte(rest, '/')
+		if end == -1 {
+			end = len(rest)
+		}
+		name := rest[1:end]
+		if name == "" {
+			return errors.New("unnamed parameter")
+		}
+		if n.param == nil {
+			n.param = &node{name: []byte(name)}
+		} else if string(n.param.name) != name {
+			return fmt.Errorf("parameter :%s conflicts with :%s", name, n.param.name)
+		}
+		return n.param.insert(rest[end:], h)
+
+	case '*':
+		name := rest[1:]
+		if name == "" || strings.IndexByte(name, '/') != -1 {
+			return errors.New("wildcard must be named and end the pattern")
+		}
+		if n.wildcard != nil {
+			return errRouteExists
+		}
+		n.wildcard = &node{name: []byte(name), handler: h}
+		return nil
+	}
+
+	static := rest
+	if i := strings.IndexAny(rest, ":*"); i != -1 {
+		static = rest[:i]
+	}
+
+	i := bytes.IndexByte(n.indices, static[0])
+	if i == -1 {
+		child := &node{prefix: static}
+		n.indices = append(n.indices, static[0])
+		n.children = append(n.children, child)
+		return child.insert(rest[len(static):], h)
+	}
+
+	child := n.children[i]
+	l := 0
+	for l < len(static) && l < len(child.prefix) && static[l] == child.prefix[l] {
+		l++
+	}
+	if l < len(child.prefix) {
+		// split the child on the common prefix
+		split := &node{
+			prefix:   child.prefix[:l],
+			indices:  []byte{child.prefix[l]},
+			children: []*node{child},
+		}
+		child.prefix = child.prefix[l:]
+		n.children[i] = split
+		child = split
+	}
+	return child.insert(rest[l:], h)
+}
+
+// lookup finds the handler for path below n, recording parameters on hp.
+func (n *node) lookup(path []byte, hp *HTTPParser) HandlerFunc {
+	if len(path) == 0 && n.handler != nil {
+		return n.handler
+	}
+
+	if len(path) > 0 {
+		if i := bytes.IndexByte(n.indices, path[0]); i != -1 {
+			child := n.children[i]
+			if len(path) >= len(child.prefix) && string(path[:len(child.prefix)]) == child.prefix {
+				if h := child.lookup(path[len(child.prefix):], hp); h != nil {
+					return h
+				}
+			}
+		}
+	}
+
+	if n.param != nil {
+		end := bytes.IndexByte(path, '/')
+		if end == -1 {
+			end = len(path)
+		}
+		if end > 0 {
+			mark := len(hp.pathParams)
+			hp.AddPathParam(n.param.name, path[:end])
+			if h := n.param.lookup(path[end:], hp); h != nil {
+				return h
+			}
+			// backtrack
+			hp.pathParams = hp.pathParams[:mark]
+		}
+	}
+
+	if n.wildcard != nil {
+		hp.AddPathParam(n.wildcard.name, path)
+		return n.wildcard.handler
+	}
+
+	return nil
+}
+
+var cAllow = []byte("Allow: ")
+
+// Use appends middleware wrapping every request the router serves.
+func (r *Router) Use(mw ...Middleware) {
+	r.mw = append(r.mw, mw...)
+	r.chain = Chain(HandlerFunc(r.dispatch), r.mw...)
+}
+
+// Serve routes the request parsed into hc and runs its handler.
+func (r *Router) Serve(hc *httpCodec) {
+	if r.chain != nil {
+		r.chain.Serve(hc)
+		return
+	}
+	r.dispatch(hc)
+}
+
+func (r *Router) dispatch(hc *httpCodec) {
+	hp := hc.parser
+	path := hp.RawPath()
+
+	h := r.lookup(hp.Method, path, hp)
+	if h == nil && bytes.Equal(hp.Method, cHEAD) {
+		// HEAD falls back to the GET route, sendBody drops the body
+		h = r.lookup(cGet, path, hp)
+	}
+	if h != nil {
+		hp.unescapePathParams()
+		h(hc)
+		return
+	}
+
+	// collect the methods the path exists for
+	allowed, get, head := false, false, false
+	for _, t := range r.trees {
+		if bytes.Equal(t.method, hp.Method) {
+			continue
+		}
+
+		mark := len(hp.pathParams)
+		h := t.root.lookup(path, hp)
+		hp.pathParams = hp.pathParams[:mark]
+		if h == nil {
+			continue
+		}
+
+		hc.header = appendAllow(hc.header, t.method, allowed)
+		allowed = true
+		get = get || bytes.Equal(t.method, cGet)
+		head = head || bytes.Equal(t.method, cHEAD)
+	}
+	if get && !head {
+		hc.header = appendAllow(hc.header, cHEAD, allowed)
+	}
+
+	if allowed {
+		hc.header = append(hc.header, "\r\n"...)
+		if r.MethodNotAllowed != nil {
+			r.MethodNotAllowed(hc)
+		} else {
+			hc.appendStatus(StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.NotFound != nil {
+		r.NotFound(hc)
+	} else {
+		hc.appendStatus(StatusNotFound)
+	}
+}
+
+// lookup finds the handler for method and path, or nil.
+func (r *Router) lookup(method, path []byte, hp *HTTPParser) HandlerFunc {
+	for _, t := range r.trees {
+		if bytes.Equal(t.method, method) {
+			return t.root.lookup(path, hp)
+		}
+	}
+	return nil
+}
+
+// appendAllow adds method to the Allow header line being built in dst.
+func appendAllow(dst, method []byte, more bool) []byte {
+	if more {
+		dst = append(dst, ", "...)
+	} else {
+		dst = append(dst, cAllow...)
+	}
+	return append(dst, method...)
+}
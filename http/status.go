@@ -0,0 +1,101 @@
+package main
+
+import "strconv"
+
+const (
+	StatusContinue           = 100
+	StatusSwitchingProtocols = 101
+
+	StatusOK        = 200
+	StatusCreated   = 201
+	StatusAccepted  = 202
+	StatusNoContent = 204
+
+	StatusMovedPermanently  = 301
+	StatusFound             = 302
+	StatusSeeOther          = 303
+	StatusNotModified       = 304
+	StatusTemporaryRedirect = 307
+	StatusPermanentRedirect = 308
+
+	StatusBadRequest                  = 400
+	StatusUnauthorized                = 401
+	StatusForbidden                   = 403
+	StatusNotFound                    = 404
+	StatusMethodNotAllowed            = 405
+	StatusRequestTimeout              = 408
+	StatusConflict                    = 409
+	StatusLengthRequired              = 411
+	StatusRequestEntityTooLarge       = 413
+	StatusRequestURITooLong           = 414
+	StatusUnsupportedMediaType        = 415
+	StatusExpectationFailed           = 417
+	StatusTooManyRequests             = 429
+	StatusRequestHeaderFieldsTooLarge = 431
+
+	StatusInternalServerError     = 500
+	StatusNotImplemented          = 501
+	StatusBadGateway              = 502
+	StatusServiceUnavailable      = 503
+	StatusGatewayTimeout          = 504
+	StatusHTTPVersionNotSupported = 505
+)
+
+var statusText = map[int]string{
+	StatusContinue:           "Continue",
+	StatusSwitchingProtocols: "Switching Protocols",
+
+	StatusOK:        "OK",
+	StatusCreated:   "Created",
+	StatusAccepted:  "Accepted",
+	StatusNoContent: "No Content",
+
+	StatusMovedPermanently:  "Moved Permanently",
+	StatusFound:             "Found",
+	StatusSeeOther:          "See Other",
+	StatusNotModified:       "Not Modified",
+	StatusTemporaryRedirect: "Temporary Redirect",
+	StatusPermanentRedirect: "Permanent Redirect",
+
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusConflict:                    "Conflict",
+	StatusLengthRequired:              "Length Required",
+	StatusRequestEntityTooLarge:       "Content Too Large",
+	StatusRequestURITooLong:           "URI Too Long",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusExpectationFailed:           "Expectation Failed",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+
+	StatusInternalServerError:     "Internal Server Error",
+	StatusNotImplemented:          "Not Implemented",
+	StatusBadGateway:              "Bad Gateway",
+	StatusServiceUnavailable:      "Service Unavailable",
+	StatusGatewayTimeout:          "Gateway Timeout",
+	StatusHTTPVersionNotSupported: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase of code, or "" if it is unknown.
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// AppendStatusLine appends "HTTP/1.1 <code> <reason>\r\n" to dst.
+func AppendStatusLine(dst []byte, code int) []byte {
+	dst = append(dst, "HTTP/1.1 "...)
+	dst = strconv.AppendInt(dst, int64(code), 10)
+	dst = append(dst, ' ')
+	if text, ok := statusText[code]; ok {
+		dst = append(dst, text...)
+	} else {
+		// RFC 9112 lets the reason be empty, but keep the separator
+		dst = append(dst, "status code "...)
+		dst = strconv.AppendInt(dst, int64(code), 10)
+	}
+	return append(dst, "\r\n"...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/vektra/errors"
+)
+
+var errBareLF = errors.Context(ErrBadProto, "bare LF line ending")
+
+// tokenTable marks the tchar set of RFC 9110 section 5.6.2.
+var tokenTable = [256]bool{
+	'!': true, '#': true, '$': true, '%': true, '&': true, '\'': true,
+	'*': true, '+': true, '-': true, '.': true, '^': true, '_': true,
+	'`': true, '|': true, '~': true,
+	'0': true, '1': true, '2': true, '3': true, '4': true,
+	'5': true, '6': true, '7': true, '8': true, '9': true,
+	'A': true, 'B': true, 'C': true, 'D': true, 'E': true, 'F': true, 'G': true,
+	'H': true, 'I': true, 'J': true, 'K': true, 'L': true, 'M': true, 'N': true,
+	'O': true, 'P': true, 'Q': true, 'R': true, 'S': true, 'T': true, 'U': true,
+	'V': true, 'W': true, 'X': true, 'Y': true, 'Z': true,
+	'a': true, 'b': true, 'c': true, 'd': true, 'e': true, 'f': true, 'g': true,
+	'h': true, 'i': true, 'j': true, 'k': true, 'l': true, 'm': true, 'n': true,
+	'o': true, 'p': true, 'q': true, 'r': true, 's': true, 't': true, 'u': true,
+	'v': true, 'w': true, 'x': true, 'y': true, 'z': true,
+}
+
+func isToken(c byte) bool {
+	return tokenTable[c]
+}
+
+// isVisible accepts VCHAR and obs-text.
+func isVisible(c byte) bool {
+	return c > ' ' && c != 0x7f
+}
+
+// isFieldValue accepts the bytes allowed inside a header value.
+func isFieldValue(c byte) bool {
+	return isVisible(c) || c == ' ' || c == '\t'
+}
+
+// validateFraming rejects a header block whose body length could be read
+// in more than one way, the root of request smuggling.
+func (hp *headerParser) validateFraming() error {
+	var contentLength, transferEncoding int
+
+	for _, h := range hp.Headers[:hp.NumHeaders] {
+		switch {
+		case bytes.EqualFold(h.Name, cContentLength):
+			contentLength++
+			if _, ok := parseContentLength(h.Value); !ok {
+				return errors.Context(ErrBadProto, "invalid content-length")
+			}
+		case bytes.EqualFold(h.Name, cTransferEncoding):
+			transferEncoding++
+		}
+	}
+
+	if contentLength > 1 {
+		return errors.Context(ErrBadProto, "duplicate content-length")
+	}
+
+	if transferEncoding > 1 {
+		return errors.Context(ErrBadProto, "duplicate transfer-encoding")
+	}
+
+	if contentLength > 0 && transferEncoding > 0 {
+		return errors.Context(ErrBadProto, "content-length with transfer-encoding")
+	}
+
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDigits(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, c := range b {
+		if !isDigit(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseContentLength parses a Content-Length value. Signs and values that
+// do not fit an int64 are refused, so the body length cannot be read in
+// another way than a proxy in front of us would.
+func parseContentLength(b []byte) (int64, bool) {
+	if !isDigits(b) {
+		return 0, false
+	}
+
+	var n int64
+	for _, c := range b {
+		d := int64(c - '0')
+		if n > (math.MaxInt64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+
+	return n, true
+}
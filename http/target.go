@@ -0,0 +1,94 @@
+package main
+
+import "bytes"
+
+var (
+	cHTTPScheme  = []byte("http://")
+	cHTTPSScheme = []byte("https://")
+	cSlash       = []byte("/")
+)
+
+// splitTarget separates the request-target into its path and query. An
+// absolute-form target ("http://host/path") is reduced to its path, "/"
+// when it has none, and a fragment, which clients must not send, is
+// dropped.
+func splitTarget(target []byte) (path, query []byte) {
+	if i := bytes.IndexByte(target, '#'); i != -1 {
+		target = target[:i]
+	}
+
+	absolute := hasPrefixFold(target, cHTTPScheme) || hasPrefixFold(target, cHTTPSScheme)
+	if absolute {
+		rest := target[bytes.IndexByte(target, ':')+3:]
+		if i := bytes.IndexAny(rest, "/?"); i != -1 {
+			target = rest[i:]
+		} else {
+			target = rest[len(rest):]
+		}
+	}
+
+	path = target
+	if i := bytes.IndexByte(target, '?'); i != -1 {
+		path, query = target[:i], target[i+1:]
+	}
+
+	// RFC 9112 section 3.2.2
+	if absolute && len(path) == 0 {
+		path = cSlash
+	}
+
+	return path, query
+}
+
+func hasPrefixFold(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && bytes.EqualFold(b[:len(prefix)], prefix)
+}
+
+func (hp *HTTPParser) readTarget() {
+	if hp.targetRead {
+		return
+	}
+
+	hp.targetRead = true
+	hp.rawPath, hp.rawQuery = splitTarget(hp.Path)
+	hp.query.Reset(hp.rawQuery)
+
+	hp.urlPath = hp.rawPath
+	if bytes.IndexByte(hp.rawPath, '%') != -1 {
+		hp.pathBuf = unescape(hp.pathBuf[:0], hp.rawPath, false)
+		hp.urlPath = hp.pathBuf
+	}
+}
+
+// Return the path of the request-target, still percent-encoded.
+func (hp *HTTPParser) RawPath() []byte {
+	hp.readTarget()
+	return hp.rawPath
+}
+
+// Return the percent-decoded path of the request-target, the thing to
+// route on. It is only valid until the next request is parsed.
+func (hp *HTTPParser) URLPath() []byte {
+	hp.readTarget()
+	return hp.urlPath
+}
+
+// Return the query string of the request-target without the '?'.
+// nil means the target had no query at all.
+func (hp *HTTPParser) RawQuery() []byte {
+	hp.readTarget()
+	return hp.rawQuery
+}
+
+// Return the decoded query parameters. The Args belongs to the parser
+// and is reset with the next request.
+func (hp *HTTPParser) QueryArgs() *Args {
+	hp.readTarget()
+	return &hp.query
+}
+
+// Return the decoded value of the first query parameter called name,
+// or nil if there is none.
+func (hp *HTTPParser) QueryArg(name []byte) []byte {
+	return hp.QueryArgs().Peek(name)
+}
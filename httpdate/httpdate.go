@@ -0,0 +1,71 @@
+// Package httpdate keeps the value of the Date response header, refreshed
+// once per second instead of formatted for every response.
+package httpdate
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout of RFC 9110, always in GMT.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type value struct {
+	b []byte
+	s string
+}
+
+var current atomic.Pointer[value]
+
+func init() {
+	Update(time.Now())
+}
+
+// Update sets the value to t. A new slice is published every time and the
+// old one is never modified, so responses may keep referencing it.
+func Update(t time.Time) {
+	b := t.UTC().AppendFormat(make([]byte, 0, len(TimeFormat)), TimeFormat)
+	current.Store(&value{b, string(b)})
+}
+
+// Load returns the current value, which must not be modified.
+func Load() []byte {
+	return current.Load().b
+}
+
+// String returns the current value as a string.
+func String() string {
+	return current.Load().s
+}
+
+// Tick updates the value and returns the time left until the next second,
+// so it can serve as the body of gnet's OnTick.
+func Tick() time.Duration {
+	now := time.Now()
+	Update(now)
+	return now.Truncate(time.Second).Add(time.Second).Sub(now)
+}
+
+// Start updates the value every second from a goroutine, for servers
+// without a ticker of their own. The returned function stops it.
+func Start() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTimer(Tick())
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				t.Reset(Tick())
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,32 @@
+package httpdate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	old := Load()
+	Update(time.Date(1994, 11, 6, 9, 49, 37, 0, time.FixedZone("CET", 3600)))
+
+	if got := string(Load()); got != "Sun, 06 Nov 1994 08:49:37 GMT" {
+		t.Errorf("Expected 'Sun, 06 Nov 1994 08:49:37 GMT', got '%s'", got)
+	}
+	if String() != string(Load()) {
+		t.Errorf("Expected String to match Load, got '%s'", String())
+	}
+	if string(old) == string(Load()) {
+		t.Errorf("Expected the previous value to be left untouched")
+	}
+}
+
+func TestTick(t *testing.T) {
+	d := Tick()
+	if d <= 0 || d > time.Second {
+		t.Errorf("Expected a delay up to one second, got %v", d)
+	}
+
+	if _, err := time.Parse(TimeFormat, String()); err != nil {
+		t.Errorf("Failed to parse '%s': %v", String(), err)
+	}
+}
@@ -2,20 +2,46 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/lesismal/nbio"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
 )
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU() * 2)
 }
 
-var rsp = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello world!")
+var (
+	rspHead = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\nDate: ")
+	rspTail = []byte("\r\n\r\nHello world!")
+	// sent while draining
+	rspCloseTail = []byte("\r\nConnection: close\r\n\r\nHello world!")
+)
+
+var drain graceful.Drainer
+
+// conns lets the drain close idle connections right away
+var conns graceful.Conns
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
 
 func main() {
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
+	flag.Parse()
+
 	engine := nbio.NewEngine(nbio.Config{
 		Network:            "tcp",
 		Addrs:              []string{":8888"},
@@ -23,21 +49,72 @@ func main() {
 		NPoller:            runtime.NumCPU(),
 	})
 
-	engine.OnData(func(c *nbio.Conn, data []byte) {
-		buf := data
-		if !bytes.Contains(buf, []byte("\r\n\r\n")) {
-			logging.Errorf("no delimiter")
-			return
+	engine.OnOpen(func(c *nbio.Conn) {
+		drain.Open()
+		// added before checking, so CloseIdle sees it if the drain
+		// starts right after
+		c.SetSession(conns.Add(c))
+		if drain.Draining() {
+			_ = c.Close()
 		}
-		_, _ = c.Write(rsp)
+	})
+	engine.OnClose(func(c *nbio.Conn, err error) {
+		conns.Remove(c)
+		drain.Close()
 	})
 
+	// the connection is busy from before every read until its data has
+	// been answered, so CloseIdle cannot drop a request read meanwhile
+	engine.OnReadBufferAlloc(func(c *nbio.Conn) []byte {
+		if cs, ok := c.Session().(*graceful.ConnState); ok {
+			// false if closed by CloseIdle, the read then fails
+			cs.Enter()
+		}
+		return engine.PollerBuffer(c)
+	})
+	engine.OnReadBufferFree(func(c *nbio.Conn, _ []byte) {
+		if cs, ok := c.Session().(*graceful.ConnState); ok {
+			cs.Leave()
+		}
+		// CloseIdle skipped it while it was busy
+		if drain.Draining() {
+			_ = c.Close()
+		}
+	})
+	engine.OnData(respond)
+
+	httpdate.Start()
+
 	err := engine.Start()
 	if err != nil {
 		fmt.Printf("nbio.Start failed: %v\n", err)
 		return
 	}
-	defer engine.Stop()
 
-	<-make(chan int)
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	drain.Begin()
+	conns.CloseIdle()
+	_ = drain.Drain(ctx)
+	if err := engine.Shutdown(ctx); err != nil {
+		fmt.Printf("nbio.Shutdown failed: %v\n", err)
+	}
+}
+
+func respond(c *nbio.Conn, data []byte) {
+	if !bytes.Contains(data, []byte("\r\n\r\n")) {
+		logging.Errorf("no delimiter")
+		return
+	}
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Write(rspHead)
+	buffer.Write(httpdate.Load())
+	if drain.Draining() {
+		buffer.Write(rspCloseTail)
+	} else {
+		buffer.Write(rspTail)
+	}
+	_, _ = c.Write(buffer.Bytes())
+	buffer.Reset()
+	bufferPool.Put(buffer)
 }
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"time"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
 )
 
 func main() {
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
+	flag.Parse()
+
 	// reuse
 	pid := os.Getpid()
 	l, err := net.Listen("tcp", ":18081")
@@ -16,10 +25,25 @@ func main() {
 		panic(err)
 	}
 	server := &http.Server{}
+	httpdate.Start()
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// net/http keeps a Date header set by the handler
+		w.Header()["Date"] = []string{httpdate.String()}
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Hello from PID %d \n", pid)
 	})
 	fmt.Printf("HTTP Server with PID: %d is running \n", pid)
-	panic(server.Serve(l))
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	// net/http closes idle connections and answers the busy ones with
+	// "Connection: close" itself
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("shutdown: %v\n", err)
+	}
 }
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -25,6 +29,10 @@ var lc = net.ListenConfig{
 }
 
 func main() {
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "time allowed to drain connections on SIGINT or SIGTERM")
+	flag.Parse()
+
 	server := &http.Server{}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -43,8 +51,24 @@ func main() {
 				panic(err)
 			}
 			fmt.Printf("HTTP Server with ID: %d is running \n", id)
-			panic(server.Serve(l))
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				panic(err)
+			}
 		}()
 	}
+
+	// this module cannot import gnet-example/graceful, so the signal is
+	// handled here
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// net/http closes idle connections and answers the busy ones with
+	// "Connection: close" itself
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("shutdown: %v\n", err)
+	}
 	wg.Wait()
 }
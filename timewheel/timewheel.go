@@ -0,0 +1,109 @@
+// Package timewheel is a hashed timing wheel for connection timeouts.
+// Arming, moving and stopping a timer are O(1) and all timers are expired
+// by one Advance call per tick, instead of a runtime timer each.
+package timewheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Timer runs a function when it expires. A Timer belongs to one Wheel
+// at a time.
+type Timer struct {
+	f          func()
+	w          *Wheel // nil while not scheduled
+	prev, next *Timer
+	rounds     int // full turns of the wheel left before it expires
+}
+
+func NewTimer(f func()) *Timer {
+	return &Timer{f: f}
+}
+
+type Wheel struct {
+	mu    sync.Mutex
+	tick  time.Duration
+	slots []Timer // list heads
+	pos   int
+	fired []func()
+}
+
+// New returns a wheel advancing by tick with size slots. Durations up to
+// size ticks cost nothing extra, longer ones are skipped once per turn.
+func New(tick time.Duration, size int) *Wheel {
+	w := &Wheel{tick: tick, slots: make([]Timer, size)}
+	for i := range w.slots {
+		head := &w.slots[i]
+		head.prev, head.next = head, head
+	}
+	return w
+}
+
+// Tick returns how often Advance must be called.
+func (w *Wheel) Tick() time.Duration {
+	return w.tick
+}
+
+// Reset schedules t to expire after d, rounded up to whole ticks,
+// replacing any earlier schedule.
+func (w *Wheel) Reset(t *Timer, d time.Duration) {
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.mu.Lock()
+	if t.w != nil {
+		t.unlink()
+	}
+	head := &w.slots[(w.pos+ticks)%len(w.slots)]
+	t.rounds = (ticks - 1) / len(w.slots)
+	t.prev, t.next = head.prev, head
+	head.prev.next = t
+	head.prev = t
+	t.w = w
+	w.mu.Unlock()
+}
+
+// Stop unschedules t, if it is scheduled.
+func (w *Wheel) Stop(t *Timer) {
+	w.mu.Lock()
+	if t.w != nil {
+		t.unlink()
+	}
+	w.mu.Unlock()
+}
+
+func (t *Timer) unlink() {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next, t.w = nil, nil, nil
+}
+
+// Advance moves the wheel by one tick and runs the functions of the
+// timers that expired, outside the lock. It must not be called
+// concurrently with itself.
+func (w *Wheel) Advance() {
+	w.mu.Lock()
+	w.pos = (w.pos + 1) % len(w.slots)
+	head := &w.slots[w.pos]
+	for t := head.next; t != head; {
+		next := t.next
+		if t.rounds > 0 {
+			t.rounds--
+		} else {
+			t.unlink()
+			w.fired = append(w.fired, t.f)
+		}
+		t = next
+	}
+	fired := w.fired
+	w.mu.Unlock()
+
+	for i, f := range fired {
+		f()
+		fired[i] = nil
+	}
+	w.fired = fired[:0]
+}
@@ -0,0 +1,54 @@
+package timewheel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWheel(t *testing.T) {
+	w := New(time.Second, 4)
+
+	var fired []string
+	a := NewTimer(func() { fired = append(fired, "a") })
+	b := NewTimer(func() { fired = append(fired, "b") })
+	c := NewTimer(func() { fired = append(fired, "c") })
+
+	w.Reset(a, 2*time.Second)
+	w.Reset(b, 1500*time.Millisecond)
+	w.Reset(c, 10*time.Second)
+
+	w.Advance()
+	if len(fired) != 0 {
+		t.Fatalf("Expected nothing after one tick, got %v", fired)
+	}
+
+	w.Advance()
+	if len(fired) != 2 {
+		t.Fatalf("Expected a and b after two ticks, got %v", fired)
+	}
+
+	// moved forward before it expires
+	w.Reset(a, time.Second)
+	w.Stop(b)
+	w.Reset(a, 3*time.Second)
+	for i := 3; i <= 10; i++ {
+		w.Advance()
+		if i == 5 && len(fired) != 3 {
+			t.Errorf("Expected a again at tick 5, got %v", fired)
+		}
+		if i < 10 && len(fired) > 3 {
+			t.Errorf("Expected c only after ten ticks, got %v at tick %d", fired, i)
+		}
+	}
+	if len(fired) != 4 || fired[3] != "c" {
+		t.Errorf("Expected c after a full turn and more, got %v", fired)
+	}
+
+	w.Stop(c)
+	for i := 0; i < 8; i++ {
+		w.Advance()
+	}
+	if len(fired) != 4 {
+		t.Errorf("Expected no more timers, got %v", fired)
+	}
+}
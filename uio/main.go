@@ -5,19 +5,30 @@ import (
 	"flag"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/panjf2000/gnet/v2/pkg/logging"
 	"github.com/urpc/uio"
+
+	"gnet-example/graceful"
+	"gnet-example/httpdate"
 )
 
-var rsp = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\nHello world!")
+var (
+	rspHead = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 12\r\nDate: ")
+	rspTail = []byte("\r\n\r\nHello world!")
+	// sent while draining
+	rspCloseTail = []byte("\r\nConnection: close\r\n\r\nHello world!")
+)
 
 func main() {
 
 	var port int
 	var loops int
+	var shutdownTimeout time.Duration
 	flag.IntVar(&port, "port", 9527, "server port")
 	flag.IntVar(&loops, "loops", 0, "server loops")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", graceful.DefaultTimeout, "time allowed to drain connections on SIGINT or SIGTERM")
 	flag.Parse()
 
 	var events uio.Events
@@ -28,7 +39,20 @@ func main() {
 			return &bytes.Buffer{}
 		},
 	}
-	events.OnData = func(c uio.Conn) error {
+	// uio registers the connection after OnOpen, so connections opened
+	// while draining are answered with "Connection: close" instead of
+	// being refused
+	var drain graceful.Drainer
+	var conns graceful.Conns
+	events.OnOpen = func(c uio.Conn) {
+		drain.Open()
+		c.SetContext(conns.Add(c))
+	}
+	events.OnClose = func(c uio.Conn, err error) {
+		conns.Remove(c)
+		drain.Close()
+	}
+	respond := func(c uio.Conn) {
 		buffer := bufferPool.Get().(*bytes.Buffer)
 		defer func() {
 			buffer.Reset()
@@ -37,15 +61,52 @@ func main() {
 		_, _ = c.WriteTo(buffer)
 		if !bytes.Contains(buffer.Bytes(), []byte("\r\n\r\n")) {
 			logging.Errorf("no delimiter")
+			return
+		}
+		buffer.Reset()
+		buffer.Write(rspHead)
+		buffer.Write(httpdate.Load())
+		if drain.Draining() {
+			buffer.Write(rspCloseTail)
+		} else {
+			buffer.Write(rspTail)
+		}
+		_, _ = c.Write(buffer.Bytes())
+	}
+	events.OnData = func(c uio.Conn) error {
+		cs, ok := c.Context().(*graceful.ConnState)
+		if !ok {
+			return c.Close()
+		}
+		// busy before respond takes the data; uio read it before OnData,
+		// so a request racing CloseIdle is lost with the connection, as
+		// one sent while an idle keep-alive connection closes is
+		if !cs.Enter() {
 			return nil
 		}
-		_, _ = c.Write(rsp)
+		respond(c)
+		cs.Leave()
+		// CloseIdle skipped it while it was busy
+		if drain.Draining() {
+			return c.Close()
+		}
 		return nil
 	}
 
+	httpdate.Start()
+
 	fmt.Printf("uio echo server with loop=%d is listening on %s\n", events.Pollers, events.Addrs[0])
 
-	if err := events.Serve(); nil != err {
-		panic(fmt.Errorf("uio server exit, error: %v", err))
-	}
+	go func() {
+		if err := events.Serve(); nil != err {
+			panic(fmt.Errorf("uio server exit, error: %v", err))
+		}
+	}()
+
+	ctx, cancel := graceful.Wait(shutdownTimeout)
+	defer cancel()
+	drain.Begin()
+	conns.CloseIdle()
+	_ = drain.Drain(ctx)
+	_ = events.Close(ctx.Err())
 }